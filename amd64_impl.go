@@ -8,6 +8,19 @@ import (
 func newAmd64FuncGen(w io.Writer, fn Function) FuncGen {
 	var GPRL = [...]string{"DI", "SI", "DX", "CX", "R8", "R9"}
 	var FPRL = [...]string{"X0", "X1", "X2", "X3", "X4", "X5", "X6", "X7"}
+	// target loads the address of the C function into R11 for StackCall and SystemCall
+	var target = func(fn *Type, name string, dlResolve bool) {
+		switch {
+		case fn != nil:
+			fmt.Fprintf(w, "\tMOVQ %s+%d(FP), R11\n", fn.name, fn.offset)
+		case name == "":
+			fmt.Fprintf(w, "\tMOVQ 0(SP), R11\n")
+		case dlResolve:
+			fmt.Fprintf(w, "\tMOVQ ·_%s(SB), R11\n", name)
+		default:
+			fmt.Fprintf(w, "\tMOVQ $%s_jmp<>(SB), R11\n", name)
+		}
+	}
 	return FuncGen{
 		PreCall: func() {
 			fmt.Fprintf(w, "\tCALL runtime·entersyscall(SB)\n")
@@ -16,36 +29,24 @@ func newAmd64FuncGen(w io.Writer, fn Function) FuncGen {
 			fmt.Fprintf(w, "\tCALL runtime·exitsyscall(SB)\n")
 		},
 		MovInst: func() func(*Type) {
-			var offset = 8 // current offset so far
 			var intC int   // the number of ints put so far
 			var floatC int // the number of floats put so far
 			return func(ty *Type) {
-				pad := func(to int) {
-					for offset%to != 0 {
-						offset++
-					}
-				}
 				switch ty.kind {
 				case U8, I8:
-					fmt.Fprintf(w, "\tMOVBLZX _%s+%d(SP), %s\n", ty.name, offset, GPRL[intC])
-					offset += 1
+					fmt.Fprintf(w, "\tMOVBLZX %s+%d(FP), %s\n", ty.name, ty.offset, GPRL[intC])
 					intC++
 					return
 				case PTR, INT, UINT, I64:
-					pad(8)
-					fmt.Fprintf(w, "\tMOVQ _%s+%d(SP), %s\n", ty.name, offset, GPRL[intC])
-					offset += 8
+					fmt.Fprintf(w, "\tMOVQ %s+%d(FP), %s\n", ty.name, ty.offset, GPRL[intC])
 					intC++
 					return
 				case I32, U32:
-					pad(4)
-					fmt.Fprintf(w, "\tMOVL _%s+%d(SP), %s\n", ty.name, offset, GPRL[intC])
-					offset += 4
+					fmt.Fprintf(w, "\tMOVL %s+%d(FP), %s\n", ty.name, ty.offset, GPRL[intC])
 					intC++
 					return
 				case F32:
-					fmt.Fprintf(w, "\tMOVSS _%s+%d(SP), %s\n", ty.name, offset, FPRL[floatC])
-					offset += 4
+					fmt.Fprintf(w, "\tMOVSS %s+%d(FP), %s\n", ty.name, ty.offset, FPRL[floatC])
 					floatC++
 					return
 				default:
@@ -54,39 +55,147 @@ func newAmd64FuncGen(w io.Writer, fn Function) FuncGen {
 			}
 		}(),
 		RetInst: func(ty *Type) {
-			var retLoc int = 8
-			for _, a := range fn.args {
-				switch a.kind {
-				case PTR, INT, I64, F64:
-					retLoc += 8
-				case U32, I32, F32:
-					retLoc += 4
-				case I8, U8:
-					retLoc++
-				default:
-					panic(fmt.Sprintf("%+v\n", a))
-				}
-			}
-			for retLoc%8 != 0 {
-				retLoc++
+			var name = ty.name
+			if name == "" {
+				name = "ret"
 			}
 			switch ty.kind {
 			case I8, U8:
-				fmt.Fprintf(w, "\tMOVB AX, ret+%d(SP)\n", retLoc)
+				fmt.Fprintf(w, "\tMOVB AX, %s+%d(FP)\n", name, ty.offset)
 			case U32, I32:
-				fmt.Fprintf(w, "\tMOVL AX, ret+%d(SP)\n", retLoc)
+				fmt.Fprintf(w, "\tMOVL AX, %s+%d(FP)\n", name, ty.offset)
 			case PTR, INT, I64, U64:
-				fmt.Fprintf(w, "\tMOVQ AX, ret+%d(SP)\n", retLoc)
+				fmt.Fprintf(w, "\tMOVQ AX, %s+%d(FP)\n", name, ty.offset)
 			default:
 				panic(ty.kind)
 			}
 		},
-		GenCall: func(name string, dlResolve bool) {
+		Acquire: func(prefix string) {
+			// LOCK XADDQ is a full barrier so the flag is read after the call is counted
+			fmt.Fprintf(w, "\tMOVQ $1, AX\n\tLOCK\n\tXADDQ AX, ·%s_inflight(SB)\n", prefix)
+			fmt.Fprintf(w, "\tMOVL ·%s_loaded(SB), AX\n", prefix)
+			fmt.Fprintf(w, "\tTESTL AX, AX\n")
+			fmt.Fprintf(w, "\tJNZ loaded\n")
+			fmt.Fprintf(w, "\tMOVQ $-1, AX\n\tLOCK\n\tXADDQ AX, ·%s_inflight(SB)\n", prefix)
+			fmt.Fprintf(w, "\tCALL ·%s_closed(SB)\n", prefix)
+			fmt.Fprintf(w, "loaded:\n")
+		},
+		Release: func(prefix string) {
+			fmt.Fprintf(w, "\tMOVQ $-1, CX\n\tLOCK\n\tXADDQ CX, ·%s_inflight(SB)\n", prefix)
+			// Close waits for the last call if the libraries aren't loaded
+			fmt.Fprintf(w, "\tCMPQ CX, $1\n\tJNE released\n")
+			fmt.Fprintf(w, "\tMOVL ·%s_loaded(SB), CX\n\tTESTL CX, CX\n\tJNZ released\n", prefix)
+			fmt.Fprintf(w, "\tCALL ·%s_drained(SB)\n", prefix)
+			fmt.Fprintf(w, "released:\n")
+		},
+		StackCall: func(stack, fn *Type, name string, dlResolve bool) {
+			target(fn, name, dlResolve)
+			if stack != nil {
+				fmt.Fprintf(w, "\tMOVQ %s+%d(FP), AX\n", stack.name, stack.offset)
+			} else { // below the return address of stackcall and aligned to 16 bytes like the C ABI wants
+				fmt.Fprintf(w, "\tLEAQ -16(SP), AX\n\tANDQ $~15, AX\n")
+			}
+			fmt.Fprintf(w, "\tCALL stackcall<>(SB)\n")
+		},
+		StackHelper: func() {
+			// It is a function of its own so the wrappers don't write SP and can be unwound.
+			fmt.Fprintf(w, "// stackcall calls R11 on the stack whose top is in AX.\n")
+			fmt.Fprintf(w, "TEXT stackcall<>(SB), NOSPLIT|NOFRAME, $0-0\n")
+			// R13 is preserved by the C function
+			fmt.Fprintf(w, "\tMOVQ SP, R13\n\tMOVQ AX, SP\n\tCALL R11\n\tMOVQ R13, SP\n\tRET\n\n")
+		},
+		SystemCall: func(fn *Type, name string, dlResolve, errno bool) {
+			target(fn, name, dlResolve)
+			fmt.Fprintf(w, "\tMOVQ R11, %d(SP)\n", systemCall+callFn)
+			for i, r := range GPRL {
+				fmt.Fprintf(w, "\tMOVQ %s, %d(SP)\n", r, systemCall+callInts+8*i)
+			}
+			for i, r := range FPRL {
+				fmt.Fprintf(w, "\tMOVSD %s, %d(SP)\n", r, systemCall+callFloats+8*i)
+			}
+			if errno {
+				fmt.Fprintf(w, "\tMOVQ $_errno_jmp<>(SB), AX\n\tMOVQ AX, %d(SP)\n", systemErrno)
+			} else {
+				fmt.Fprintf(w, "\tMOVQ $0, %d(SP)\n", systemErrno)
+			}
+			fmt.Fprintf(w, "\tMOVQ $systemcall<>(SB), AX\n\tMOVQ AX, 0(SP)\n")
+			fmt.Fprintf(w, "\tLEAQ %d(SP), AX\n\tMOVQ AX, 8(SP)\n", systemCall)
+			fmt.Fprintf(w, "\tCALL runtime·asmcgocall(SB)\n")
+			fmt.Fprintf(w, "\tMOVQ %d(SP), AX\n", systemCall+callRet)
+		},
+		SystemHelper: func() {
+			// it's called by asmcgocall like a C function with the call in DI
+			fmt.Fprintf(w, "// systemcall makes the call recorded at DI. If the word after the call\n")
+			fmt.Fprintf(w, "// has the errno location function, it is replaced with errno.\n")
+			fmt.Fprintf(w, "TEXT systemcall<>(SB), NOSPLIT|NOFRAME, $0-0\n")
+			// BX and R12 are preserved for the caller and the stack is aligned to 16 bytes for the calls
+			fmt.Fprintf(w, "\tPUSHQ BX\n\tPUSHQ R12\n\tSUBQ $8, SP\n\tMOVQ DI, BX\n")
+			fmt.Fprintf(w, "\tMOVQ %d(BX), R11\n\tTESTQ R11, R11\n\tJZ call\n", callSize)
+			// R12 is preserved by the C function
+			fmt.Fprintf(w, "\tCALL R11\n\tMOVQ AX, R12\n\tMOVL $0, (R12)\n")
+			fmt.Fprintf(w, "call:\n")
+			for i, r := range GPRL {
+				fmt.Fprintf(w, "\tMOVQ %d(BX), %s\n", callInts+8*i, r)
+			}
+			for i, r := range FPRL {
+				fmt.Fprintf(w, "\tMOVSD %d(BX), %s\n", callFloats+8*i, r)
+			}
+			fmt.Fprintf(w, "\tMOVQ %d(BX), R11\n\tCALL R11\n", callFn)
+			fmt.Fprintf(w, "\tMOVQ AX, %d(BX)\n", callRet)
+			fmt.Fprintf(w, "\tMOVQ %d(BX), R11\n\tTESTQ R11, R11\n\tJZ done\n", callSize)
+			fmt.Fprintf(w, "\tMOVLQSX (R12), R11\n\tMOVQ R11, %d(BX)\n", callSize)
+			fmt.Fprintf(w, "done:\n\tADDQ $8, SP\n\tPOPQ R12\n\tPOPQ BX\n\tRET\n\n")
+		},
+		Jump: func(name, wrapper string, dlResolve bool) {
+			// DX is the context register of the shared wrapper
 			if dlResolve {
-				fmt.Fprintf(w, "\tMOVD ·_%s(SB), AX\n\tCALL AX\n", name)
+				fmt.Fprintf(w, "\tMOVQ ·_%s(SB), DX\n", name)
 			} else {
-				fmt.Fprintf(w, "\tCALL _%s(SB)\n", name)
+				fmt.Fprintf(w, "\tMOVQ $%s_jmp<>(SB), DX\n", name)
 			}
+			fmt.Fprintf(w, "\tJMP ·%s(SB)\n", wrapper)
+		},
+		SaveContext: func() {
+			// the arguments overwrite DX and SystemCall only uses the slot after the address is loaded again
+			fmt.Fprintf(w, "\tMOVQ DX, 0(SP)\n")
+		},
+		ClearErrno: func() {
+			// BX is preserved by the C function
+			fmt.Fprintf(w, "\tMOVQ AX, BX\n\tMOVL $0, (BX)\n")
+		},
+		Errno: func(errno *Type) {
+			fmt.Fprintf(w, "\tMOVLQSX (BX), CX\n\tMOVQ CX, %s+%d(FP)\n", errno.name, errno.offset)
+		},
+		SystemErrno: func(errno *Type) {
+			fmt.Fprintf(w, "\tMOVQ %d(SP), CX\n\tMOVQ CX, %s+%d(FP)\n", systemErrno, errno.name, errno.offset)
+		},
+		Batch: func() {
+			fmt.Fprintf(w, "// func _onlygo_batch(calls *_onlygo_call, n int)\n")
+			fmt.Fprintf(w, "TEXT ·_onlygo_batch(SB), NOSPLIT, $0-16\n\tGO_ARGS\n\tNO_LOCAL_POINTERS\n")
+			fmt.Fprintf(w, "\tCALL runtime·entersyscall(SB)\n")
+			// BX and R12 are preserved by the C functions
+			fmt.Fprintf(w, "\tMOVQ calls+0(FP), BX\n\tMOVQ n+8(FP), R12\n\tJMP check\n")
+			fmt.Fprintf(w, "next:\n")
+			for i, r := range GPRL {
+				fmt.Fprintf(w, "\tMOVQ %d(BX), %s\n", callInts+8*i, r)
+			}
+			for i, r := range FPRL {
+				fmt.Fprintf(w, "\tMOVSD %d(BX), %s\n", callFloats+8*i, r)
+			}
+			fmt.Fprintf(w, "\tMOVQ %d(BX), R11\n", callFn)
+			fmt.Fprintf(w, "\tLEAQ -16(SP), AX\n\tANDQ $~15, AX\n")
+			fmt.Fprintf(w, "\tCALL stackcall<>(SB)\n")
+			fmt.Fprintf(w, "\tMOVQ AX, %d(BX)\n", callRet)
+			fmt.Fprintf(w, "\tADDQ $%d, BX\n\tDECQ R12\n", callSize)
+			fmt.Fprintf(w, "check:\n\tTESTQ R12, R12\n\tJNZ next\n")
+			fmt.Fprintf(w, "\tCALL runtime·exitsyscall(SB)\n\tRET\n\n")
+		},
+		Resolve: func(name string) {
+			fmt.Fprintf(w, "\tMOVQ ·_%s(SB), AX\n", name)
+			fmt.Fprintf(w, "\tTESTQ AX, AX\n")
+			fmt.Fprintf(w, "\tJNZ resolved\n")
+			fmt.Fprintf(w, "\tCALL ·_%s_resolve(SB)\n", name)
+			fmt.Fprintf(w, "resolved:\n")
 		},
 	}
 }
@@ -107,9 +107,40 @@ func sizeof(ty *Type) (ret int) {
 	}
 }
 
+// alignof returns the alignment in bytes of a type
+func alignof(ty *Type) int {
+	switch ty.kind {
+	case ARRAY:
+		return alignof(ty.underlyingType)
+	case STRUCT:
+		var max = 1
+		for _, t := range ty.fields {
+			if a := alignof(t); a > max {
+				max = a
+			}
+		}
+		return max
+	default:
+		return sizeof(&Type{kind: ty.kind})
+	}
+}
+
 func newArm64FuncGen(w io.Writer, fn Function) FuncGen {
 	var x = [...]string{"R0", "R1", "R2", "R3", "R4", "R5", "R6", "R7"}
 	var v = [...]string{"F0", "F1", "F2", "F3", "F4", "F5", "F6", "F7"}
+	// target loads the address of the C function into R16 for StackCall and SystemCall
+	var target = func(fn *Type, name string, dlResolve bool) {
+		switch {
+		case fn != nil:
+			_, _ = fmt.Fprintf(w, "\tMOVD %s+%d(FP), R16\n", fn.name, fn.offset)
+		case name == "":
+			_, _ = fmt.Fprintf(w, "\tMOVD 8(RSP), R16\n")
+		case dlResolve:
+			_, _ = fmt.Fprintf(w, "\tMOVD ·_%s(SB), R16\n", name)
+		default:
+			_, _ = fmt.Fprintf(w, "\tMOVD $%s_jmp<>(SB), R16\n", name)
+		}
+	}
 	return FuncGen{
 		PreCall: func() {
 			_, _ = fmt.Fprintf(w, "\tBL runtime·entersyscall(SB)\n")
@@ -118,62 +149,38 @@ func newArm64FuncGen(w io.Writer, fn Function) FuncGen {
 			_, _ = fmt.Fprintf(w, "\tBL runtime·exitsyscall(SB)\n")
 		},
 		MovInst: func() func(*Type) {
-			var offset int // current offset so far
-			var NGRN int   // A.1 - the number of ints put so far
-			var NSRN int   // A.2 - the number of floats put so far
-			var NSAA = 16  // A.3 - the current stack pointer
-			pad := func(to int) {
-				for offset%to != 0 {
-					offset++
-				}
-			}
+			var NGRN int  // A.1 - the number of ints put so far
+			var NSRN int  // A.2 - the number of floats put so far
+			var NSAA = 16 // A.3 - the current stack pointer
 			writeFloat32 := func(ty *Type) {
-				pad(4)
-				_, _ = fmt.Fprintf(w, "\tFMOVD _%s+%d(FP), %s\n", ty.name, offset, v[NSRN])
-				offset += 4
+				_, _ = fmt.Fprintf(w, "\tFMOVD %s+%d(FP), %s\n", ty.name, ty.offset, v[NSRN])
 			}
 			writeFloat64 := func(ty *Type) {
-				pad(8)
-				_, _ = fmt.Fprintf(w, "\tFMOVD _%s+%d(FP), %s\n", ty.name, offset, v[NSRN])
-				offset += 8
+				_, _ = fmt.Fprintf(w, "\tFMOVD %s+%d(FP), %s\n", ty.name, ty.offset, v[NSRN])
 			}
 			writeU8 := func(ty *Type) {
-				_, _ = fmt.Fprintf(w, "\tMOVBU _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 1
+				_, _ = fmt.Fprintf(w, "\tMOVBU %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeI8 := func(ty *Type) {
-				_, _ = fmt.Fprintf(w, "\tMOVB _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 1
+				_, _ = fmt.Fprintf(w, "\tMOVB %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeU16 := func(ty *Type) {
-				pad(2)
-				_, _ = fmt.Fprintf(w, "\tMOVHU _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 2
+				_, _ = fmt.Fprintf(w, "\tMOVHU %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeI16 := func(ty *Type) {
-				pad(2)
-				_, _ = fmt.Fprintf(w, "\tMOVH _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 2
+				_, _ = fmt.Fprintf(w, "\tMOVH %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeU32 := func(ty *Type) {
-				pad(4)
-				_, _ = fmt.Fprintf(w, "\tMOVWU _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 4
+				_, _ = fmt.Fprintf(w, "\tMOVWU %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeI32 := func(ty *Type) {
-				pad(4)
-				_, _ = fmt.Fprintf(w, "\tMOVW _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 4
+				_, _ = fmt.Fprintf(w, "\tMOVW %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeU64 := func(ty *Type) {
-				pad(8)
-				_, _ = fmt.Fprintf(w, "\tMOVDU _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 8
+				_, _ = fmt.Fprintf(w, "\tMOVDU %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			writeI64 := func(ty *Type) {
-				pad(8)
-				_, _ = fmt.Fprintf(w, "\tMOVD _%s+%d(FP), %s\n", ty.name, offset, x[NGRN])
-				offset += 8
+				_, _ = fmt.Fprintf(w, "\tMOVD %s+%d(FP), %s\n", ty.name, ty.offset, x[NGRN])
 			}
 			return func(ty *Type) {
 				// B.1
@@ -395,39 +402,150 @@ func newArm64FuncGen(w io.Writer, fn Function) FuncGen {
 			}
 		}(),
 		RetInst: func(ty *Type) {
-			var retLoc int
-			for _, a := range fn.args {
-				switch a.kind {
-				case PTR, INT, I64, F64:
-					retLoc += 8
-				case U32, I32, F32:
-					retLoc += 4
-				case I8, U8:
-					retLoc++
-				default:
-					panic(fmt.Sprintf("%+v\n", a))
-				}
-			}
-			for retLoc%8 != 0 {
-				retLoc++
+			var name = ty.name
+			if name == "" {
+				name = "ret"
 			}
 			switch ty.kind {
 			case I8, U8:
-				_, _ = fmt.Fprintf(w, "\tMOVB R0, ret+%d(FP)\n", retLoc)
+				_, _ = fmt.Fprintf(w, "\tMOVB R0, %s+%d(FP)\n", name, ty.offset)
 			case U32, I32:
-				_, _ = fmt.Fprintf(w, "\tMOVW R0, ret+%d(FP)\n", retLoc)
+				_, _ = fmt.Fprintf(w, "\tMOVW R0, %s+%d(FP)\n", name, ty.offset)
 			case PTR, INT, I64, U64:
-				_, _ = fmt.Fprintf(w, "\tMOVD R0, ret+%d(FP)\n", retLoc)
+				_, _ = fmt.Fprintf(w, "\tMOVD R0, %s+%d(FP)\n", name, ty.offset)
 			default:
 				panic(ty.kind)
 			}
 		},
-		GenCall: func(name string, resolveDL bool) {
-			if resolveDL {
-				_, _ = fmt.Fprintf(w, "\tMOVD ·_%s(SB), R16\n\tCALL R16\n", name)
+		Acquire: func(prefix string) {
+			// the store-release of the count is ordered before the load-acquire of the flag
+			_, _ = fmt.Fprintf(w, "\tMOVD $·%s_inflight(SB), R16\n", prefix)
+			_, _ = fmt.Fprintf(w, "acquire:\n\tLDAXR (R16), R17\n\tADD $1, R17\n\tSTLXR R17, (R16), R19\n\tCBNZ R19, acquire\n")
+			_, _ = fmt.Fprintf(w, "\tMOVD $·%s_loaded(SB), R17\n", prefix)
+			_, _ = fmt.Fprintf(w, "\tLDARW (R17), R17\n")
+			_, _ = fmt.Fprintf(w, "\tCBNZW R17, loaded\n")
+			_, _ = fmt.Fprintf(w, "abort:\n\tLDAXR (R16), R17\n\tSUB $1, R17\n\tSTLXR R17, (R16), R19\n\tCBNZ R19, abort\n")
+			_, _ = fmt.Fprintf(w, "\tCALL ·%s_closed(SB)\n", prefix)
+			_, _ = fmt.Fprintf(w, "loaded:\n")
+		},
+		Release: func(prefix string) {
+			_, _ = fmt.Fprintf(w, "\tMOVD $·%s_inflight(SB), R16\n", prefix)
+			_, _ = fmt.Fprintf(w, "release:\n\tLDAXR (R16), R17\n\tSUB $1, R17\n\tSTLXR R17, (R16), R19\n\tCBNZ R19, release\n")
+			// Close waits for the last call if the libraries aren't loaded
+			_, _ = fmt.Fprintf(w, "\tCBNZ R17, released\n")
+			_, _ = fmt.Fprintf(w, "\tMOVD $·%s_loaded(SB), R17\n", prefix)
+			_, _ = fmt.Fprintf(w, "\tLDARW (R17), R17\n")
+			_, _ = fmt.Fprintf(w, "\tCBNZW R17, released\n")
+			_, _ = fmt.Fprintf(w, "\tCALL ·%s_drained(SB)\n", prefix)
+			_, _ = fmt.Fprintf(w, "released:\n")
+		},
+		StackCall: func(stack, fn *Type, name string, dlResolve bool) {
+			target(fn, name, dlResolve)
+			if stack != nil {
+				_, _ = fmt.Fprintf(w, "\tMOVD %s+%d(FP), R17\n", stack.name, stack.offset)
+			} else { // RSP is always aligned to 16 bytes
+				_, _ = fmt.Fprintf(w, "\tMOVD RSP, R17\n")
+			}
+			_, _ = fmt.Fprintf(w, "\tCALL stackcall<>(SB)\n")
+		},
+		StackHelper: func() {
+			// It is a function of its own so the wrappers don't write RSP and can be unwound.
+			_, _ = fmt.Fprintf(w, "// stackcall calls R16 on the stack whose top is in R17.\n")
+			_, _ = fmt.Fprintf(w, "TEXT stackcall<>(SB), NOSPLIT|NOFRAME, $0-0\n")
+			// R20 and R21 are preserved by the C function
+			_, _ = fmt.Fprintf(w, "\tMOVD RSP, R20\n\tMOVD R30, R21\n\tMOVD R17, RSP\n\tCALL R16\n\tMOVD R20, RSP\n\tMOVD R21, R30\n\tRET\n\n")
+		},
+		SystemCall: func(fn *Type, name string, dlResolve, errno bool) {
+			target(fn, name, dlResolve)
+			_, _ = fmt.Fprintf(w, "\tMOVD R16, %d(RSP)\n", systemCall+callFn)
+			for i, r := range x {
+				_, _ = fmt.Fprintf(w, "\tMOVD %s, %d(RSP)\n", r, systemCall+callInts+8*i)
+			}
+			for i, r := range v {
+				_, _ = fmt.Fprintf(w, "\tFMOVD %s, %d(RSP)\n", r, systemCall+callFloats+8*i)
+			}
+			if errno {
+				_, _ = fmt.Fprintf(w, "\tMOVD $_errno_jmp<>(SB), R0\n\tMOVD R0, %d(RSP)\n", systemErrno)
+			} else {
+				_, _ = fmt.Fprintf(w, "\tMOVD ZR, %d(RSP)\n", systemErrno)
+			}
+			_, _ = fmt.Fprintf(w, "\tMOVD $systemcall<>(SB), R0\n\tMOVD R0, 8(RSP)\n")
+			_, _ = fmt.Fprintf(w, "\tADD $%d, RSP, R0\n\tMOVD R0, 16(RSP)\n", systemCall)
+			_, _ = fmt.Fprintf(w, "\tCALL runtime·asmcgocall(SB)\n")
+			_, _ = fmt.Fprintf(w, "\tMOVD %d(RSP), R0\n", systemCall+callRet)
+		},
+		SystemHelper: func() {
+			// it's called by asmcgocall like a C function with the call in R0
+			_, _ = fmt.Fprintf(w, "// systemcall makes the call recorded at R0. If the word after the call\n")
+			_, _ = fmt.Fprintf(w, "// has the errno location function, it is replaced with errno.\n")
+			_, _ = fmt.Fprintf(w, "TEXT systemcall<>(SB), NOSPLIT|NOFRAME, $0-0\n")
+			// R19, R20 and the link register are preserved for the caller
+			_, _ = fmt.Fprintf(w, "\tSTP.W (R19, R30), -32(RSP)\n\tMOVD R20, 16(RSP)\n\tMOVD R0, R19\n")
+			_, _ = fmt.Fprintf(w, "\tMOVD %d(R19), R16\n\tCBZ R16, call\n", callSize)
+			// R20 is preserved by the C function
+			_, _ = fmt.Fprintf(w, "\tCALL R16\n\tMOVD R0, R20\n\tMOVW ZR, (R20)\n")
+			_, _ = fmt.Fprintf(w, "call:\n")
+			for i, r := range x {
+				_, _ = fmt.Fprintf(w, "\tMOVD %d(R19), %s\n", callInts+8*i, r)
+			}
+			for i, r := range v {
+				_, _ = fmt.Fprintf(w, "\tFMOVD %d(R19), %s\n", callFloats+8*i, r)
+			}
+			_, _ = fmt.Fprintf(w, "\tMOVD %d(R19), R16\n\tCALL R16\n", callFn)
+			_, _ = fmt.Fprintf(w, "\tMOVD R0, %d(R19)\n", callRet)
+			_, _ = fmt.Fprintf(w, "\tMOVD %d(R19), R16\n\tCBZ R16, done\n", callSize)
+			_, _ = fmt.Fprintf(w, "\tMOVW (R20), R1\n\tMOVD R1, %d(R19)\n", callSize)
+			_, _ = fmt.Fprintf(w, "done:\n\tMOVD 16(RSP), R20\n\tLDP.P 32(RSP), (R19, R30)\n\tRET\n\n")
+		},
+		Jump: func(name, wrapper string, dlResolve bool) {
+			// R26 is the context register of the shared wrapper
+			if dlResolve {
+				_, _ = fmt.Fprintf(w, "\tMOVD ·_%s(SB), R26\n", name)
 			} else {
-				_, _ = fmt.Fprintf(w, "\tCALL _%s(SB)\n", name)
+				_, _ = fmt.Fprintf(w, "\tMOVD $%s_jmp<>(SB), R26\n", name)
 			}
+			_, _ = fmt.Fprintf(w, "\tJMP ·%s(SB)\n", wrapper)
+		},
+		SaveContext: func() {
+			// 0(RSP) has the saved LR, the arguments overwrite R26 and SystemCall
+			// only uses the slot after the address is loaded again
+			_, _ = fmt.Fprintf(w, "\tMOVD R26, 8(RSP)\n")
+		},
+		ClearErrno: func() {
+			// R22 is preserved by the C function
+			_, _ = fmt.Fprintf(w, "\tMOVD R0, R22\n\tMOVW ZR, (R22)\n")
+		},
+		Errno: func(errno *Type) {
+			_, _ = fmt.Fprintf(w, "\tMOVW (R22), R1\n\tMOVD R1, %s+%d(FP)\n", errno.name, errno.offset)
+		},
+		SystemErrno: func(errno *Type) {
+			_, _ = fmt.Fprintf(w, "\tMOVD %d(RSP), R1\n\tMOVD R1, %s+%d(FP)\n", systemErrno, errno.name, errno.offset)
+		},
+		Batch: func() {
+			_, _ = fmt.Fprintf(w, "// func _onlygo_batch(calls *_onlygo_call, n int)\n")
+			_, _ = fmt.Fprintf(w, "TEXT ·_onlygo_batch(SB), NOSPLIT, $0-16\n\tGO_ARGS\n\tNO_LOCAL_POINTERS\n")
+			_, _ = fmt.Fprintf(w, "\tBL runtime·entersyscall(SB)\n")
+			// R19 and R22 are preserved by the C functions
+			_, _ = fmt.Fprintf(w, "\tMOVD calls+0(FP), R19\n\tMOVD n+8(FP), R22\n\tCBZ R22, done\n")
+			_, _ = fmt.Fprintf(w, "next:\n")
+			for i, r := range x {
+				_, _ = fmt.Fprintf(w, "\tMOVD %d(R19), %s\n", callInts+8*i, r)
+			}
+			for i, r := range v {
+				_, _ = fmt.Fprintf(w, "\tFMOVD %d(R19), %s\n", callFloats+8*i, r)
+			}
+			_, _ = fmt.Fprintf(w, "\tMOVD %d(R19), R16\n", callFn)
+			_, _ = fmt.Fprintf(w, "\tMOVD RSP, R17\n")
+			_, _ = fmt.Fprintf(w, "\tCALL stackcall<>(SB)\n")
+			_, _ = fmt.Fprintf(w, "\tMOVD R0, %d(R19)\n", callRet)
+			_, _ = fmt.Fprintf(w, "\tADD $%d, R19\n\tSUB $1, R22\n\tCBNZ R22, next\n", callSize)
+			_, _ = fmt.Fprintf(w, "done:\n\tBL runtime·exitsyscall(SB)\n\tRET\n\n")
+		},
+		Resolve: func(name string) {
+			_, _ = fmt.Fprintf(w, "\tMOVD ·_%s(SB), R16\n", name)
+			_, _ = fmt.Fprintf(w, "\tCBNZ R16, resolved\n")
+			_, _ = fmt.Fprintf(w, "\tCALL ·_%s_resolve(SB)\n", name)
+			_, _ = fmt.Fprintf(w, "resolved:\n")
 		},
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fastcallFixture has the same C function wrapped with and without //onlygo:fastcall
+// and a benchmark for each of them.
+var fastcallFixture = map[string]string{
+	"libc.stub": `package fixture
+
+//onlygo:resolve_with_cgo
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+
+//onlygo:fastcall
+//onlygo:linkname strlen
+func StrlenFast(s *byte) uintptr
+`,
+	"libc_test.go": `package fixture
+
+import "testing"
+
+var s = &[]byte("hello\x00")[0]
+
+func BenchmarkCall(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Strlen(s)
+	}
+}
+
+func BenchmarkFastcall(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		StrlenFast(s)
+	}
+}
+`,
+}
+
+// BenchmarkFastcall compares calls that tell the scheduler with ones marked
+// //onlygo:fastcall on each platform. The calls are made by a test binary built
+// without cgo, so only the platform of the host is run.
+func BenchmarkFastcall(b *testing.B) {
+	var dir = generateModule(b, fastcallFixture)
+	for _, p := range targets {
+		b.Run(p[0]+"_"+p[1], func(b *testing.B) {
+			if p[0] != runtime.GOOS || p[1] != runtime.GOARCH {
+				b.Skipf("can't run %s/%s on %s/%s", p[0], p[1], runtime.GOOS, runtime.GOARCH)
+			}
+			var bin = filepath.Join(b.TempDir(), "fixture.test")
+			goCommand(b, dir, []string{"CGO_ENABLED=0"}, "test", "-c", "-ldflags=-checklinkname=0", "-o", bin, ".")
+			for _, name := range []string{"Call", "Fastcall"} {
+				b.Run(name, func(b *testing.B) {
+					b.ReportMetric(runBenchmark(b, bin, name), "ns/op")
+				})
+			}
+		})
+	}
+}
+
+// runBenchmark runs the benchmark name of the test binary bin b.N times
+// and returns the time it took per call in nanoseconds.
+func runBenchmark(b *testing.B, bin, name string) float64 {
+	b.Helper()
+	var cmd = exec.Command(bin, "-test.run=^$", "-test.bench=^Benchmark"+name+"$", "-test.benchtime="+strconv.Itoa(b.N)+"x")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		b.Fatalf("%s: %v\n%s", name, err, out)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		var fields = strings.Fields(line)
+		for i := 1; i < len(fields); i++ {
+			if fields[i] == "ns/op" && strings.HasPrefix(fields[0], "Benchmark"+name) {
+				ns, err := strconv.ParseFloat(fields[i-1], 64)
+				if err != nil {
+					b.Fatal(err)
+				}
+				return ns
+			}
+		}
+	}
+	b.Fatalf("%s reported no ns/op\n%s", name, out)
+	return 0
+}
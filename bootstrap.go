@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Unless runtime/cgo is linked in the Go runtime creates its threads with clone and
+// sets up their thread local storage itself so libc never sees them. Calling libc
+// from such a thread uses a thread control block that was never initialized and
+// anything that touches errno, malloc arenas or the locale crashes sooner or later.
+// The bootstrap takes the place of runtime/cgo: it sets runtime.iscgo so the runtime
+// asks _cgo_thread_start to create every thread, which is done with pthread_create.
+// The variables of the runtime it sets can only be defined once so only one package
+// of a program can have the bootstrap.
+
+// bootstrapGo is the Go file of the bootstrap that imports the libc functions it calls.
+const bootstrapGo = `// File generated using onlygo. DO NOT EDIT!!!
+
+//go:build !cgo
+
+package %s
+
+import _ "unsafe" // for go:cgo_import_dynamic
+
+//go:cgo_import_dynamic _ _ "libc.so.6"
+//go:cgo_import_dynamic _ _ "libpthread.so.0"
+//go:cgo_import_dynamic _onlygo_malloc malloc "libc.so.6"
+//go:cgo_import_dynamic _onlygo_free free "libc.so.6"
+//go:cgo_import_dynamic _onlygo_abort abort "libc.so.6"
+//go:cgo_import_dynamic _onlygo_setenv setenv "libc.so.6"
+//go:cgo_import_dynamic _onlygo_unsetenv unsetenv "libc.so.6"
+//go:cgo_import_dynamic _onlygo_sigfillset sigfillset "libc.so.6"
+//go:cgo_import_dynamic _onlygo_pthread_sigmask pthread_sigmask "libc.so.6"
+//go:cgo_import_dynamic _onlygo_pthread_create pthread_create "libpthread.so.0"
+//go:cgo_import_dynamic _onlygo_pthread_attr_init pthread_attr_init "libpthread.so.0"
+//go:cgo_import_dynamic _onlygo_pthread_attr_getstacksize pthread_attr_getstacksize "libpthread.so.0"
+//go:cgo_import_dynamic _onlygo_pthread_attr_destroy pthread_attr_destroy "libpthread.so.0"
+`
+
+// bootstrapCgo is the Go file that links in the real runtime/cgo when cgo is enabled.
+const bootstrapCgo = `// File generated using onlygo. DO NOT EDIT!!!
+
+//go:build cgo
+
+package %s
+
+import _ "runtime/cgo" // creates the threads of the runtime with pthread_create
+`
+
+// bootstrapData are the variables of the runtime that the bootstrap sets.
+// They are the same on every GOARCH.
+const bootstrapData = `
+// the runtime checks that these are set when iscgo is
+DATA runtime·iscgo(SB)/1, $1
+GLOBL runtime·iscgo(SB), NOPTR, $1
+DATA _cgo_init(SB)/8, $cgo_init<>(SB)
+GLOBL _cgo_init(SB), NOPTR, $8
+DATA _cgo_thread_start(SB)/8, $cgo_thread_start<>(SB)
+GLOBL _cgo_thread_start(SB), NOPTR, $8
+DATA _cgo_notify_runtime_init_done(SB)/8, $cgo_nop<>(SB)
+GLOBL _cgo_notify_runtime_init_done(SB), NOPTR, $8
+DATA _cgo_pthread_key_created(SB)/8, $cgo_pthread_key_created<>(SB)
+GLOBL _cgo_pthread_key_created(SB), NOPTR, $8
+DATA runtime·_cgo_setenv(SB)/8, $cgo_setenv<>(SB)
+GLOBL runtime·_cgo_setenv(SB), NOPTR, $8
+DATA runtime·_cgo_unsetenv(SB)/8, $cgo_unsetenv<>(SB)
+GLOBL runtime·_cgo_unsetenv(SB), NOPTR, $8
+DATA runtime·set_crosscall2(SB)/8, $set_crosscall2<>(SB)
+GLOBL runtime·set_crosscall2(SB), NOPTR, $8
+
+// set_crosscall2 is a func value that does nothing
+DATA set_crosscall2<>(SB)/8, $cgo_nop<>(SB)
+GLOBL set_crosscall2<>(SB), RODATA, $8
+GLOBL cgo_pthread_key_created<>(SB), NOPTR, $8
+// setg_gcc of the runtime which _cgo_init is called with
+GLOBL setg_gcc<>(SB), NOPTR, $8
+`
+
+// bootstrapAsm is the assembly of the bootstrap on each GOARCH. The functions
+// are called with the C calling convention.
+var bootstrapAsm = map[string]string{
+	"amd64": `// _cgo_init(g0 *g, setg_gcc uintptr) saves setg_gcc and sets the
+// bottom of the stack of g0 to the bottom of the stack of the main thread.
+TEXT cgo_init<>(SB), NOSPLIT|NOFRAME, $0-0
+	PUSHQ BP
+	MOVQ SP, BP
+	PUSHQ R12
+	PUSHQ R13
+	SUBQ $80, SP // pthread_attr_t at 0(SP) and its stack size at 64(SP)
+	MOVQ SI, setg_gcc<>(SB)
+	MOVQ DI, R12
+	MOVQ SP, DI
+	CALL _onlygo_pthread_attr_init(SB)
+	MOVQ SP, DI
+	LEAQ 64(SP), SI
+	CALL _onlygo_pthread_attr_getstacksize(SB)
+	LEAQ 4096(SP), AX // a page above the stack size below SP
+	SUBQ 64(SP), AX
+	MOVQ AX, 0(R12) // g.stack.lo
+	MOVQ SP, DI
+	CALL _onlygo_pthread_attr_destroy(SB)
+	ADDQ $80, SP
+	POPQ R13
+	POPQ R12
+	POPQ BP
+	RET
+
+// _cgo_thread_start(ts *ThreadStart) creates a thread with pthread_create that
+// calls ts.fn with g set to ts.g. Every signal is blocked while it is created.
+TEXT cgo_thread_start<>(SB), NOSPLIT|NOFRAME, $0-0
+	PUSHQ BP
+	MOVQ SP, BP
+	PUSHQ R12
+	PUSHQ R13
+	SUBQ $336, SP // pthread_attr_t at 0(SP), its stack size at 64(SP), pthread_t at 72(SP) and two sigset_t at 80(SP) and 208(SP)
+	MOVQ DI, R12
+	MOVQ $24, DI // the new thread frees the copy of ts
+	CALL _onlygo_malloc(SB)
+	TESTQ AX, AX
+	JZ fail
+	MOVQ 0(R12), CX
+	MOVQ CX, 0(AX)
+	MOVQ 8(R12), CX
+	MOVQ CX, 8(AX)
+	MOVQ 16(R12), CX
+	MOVQ CX, 16(AX)
+	MOVQ AX, R13
+	LEAQ 80(SP), DI
+	CALL _onlygo_sigfillset(SB)
+	MOVQ $2, DI // SIG_SETMASK
+	LEAQ 80(SP), SI
+	LEAQ 208(SP), DX
+	CALL _onlygo_pthread_sigmask(SB)
+	MOVQ SP, DI
+	CALL _onlygo_pthread_attr_init(SB)
+	MOVQ SP, DI
+	LEAQ 64(SP), SI
+	CALL _onlygo_pthread_attr_getstacksize(SB)
+	MOVQ 0(R13), CX
+	MOVQ 64(SP), AX
+	MOVQ AX, 8(CX) // g.stack.hi is the size until the thread knows where its stack is
+	LEAQ 72(SP), DI
+	MOVQ SP, SI
+	MOVQ $threadentry<>(SB), DX
+	MOVQ R13, CX
+	CALL _onlygo_pthread_create(SB)
+	MOVQ AX, R12
+	MOVQ $2, DI
+	LEAQ 208(SP), SI
+	XORQ DX, DX
+	CALL _onlygo_pthread_sigmask(SB)
+	MOVQ SP, DI
+	CALL _onlygo_pthread_attr_destroy(SB)
+	TESTQ R12, R12
+	JNZ fail
+	ADDQ $336, SP
+	POPQ R13
+	POPQ R12
+	POPQ BP
+	RET
+fail:
+	CALL _onlygo_abort(SB)
+	RET
+
+// threadentry(ts *ThreadStart) is the start routine of every thread the runtime creates.
+TEXT threadentry<>(SB), NOSPLIT|NOFRAME, $0-0
+	PUSHQ BP
+	MOVQ SP, BP
+	MOVQ 0(DI), R12 // g
+	MOVQ 16(DI), R13 // fn
+	CALL _onlygo_free(SB)
+	MOVQ R12, DI
+	MOVQ setg_gcc<>(SB), AX
+	CALL AX
+	CALL R13 // doesn't return
+	CALL _onlygo_abort(SB)
+	POPQ BP
+	RET
+
+// _cgo_setenv(arg *[2]*byte) calls setenv(arg[0], arg[1], 1)
+TEXT cgo_setenv<>(SB), NOSPLIT|NOFRAME, $0-0
+	PUSHQ BP
+	MOVQ SP, BP
+	MOVQ 8(DI), SI
+	MOVQ 0(DI), DI
+	MOVQ $1, DX
+	CALL _onlygo_setenv(SB)
+	POPQ BP
+	RET
+
+// _cgo_unsetenv(arg *[1]*byte) calls unsetenv(arg[0])
+TEXT cgo_unsetenv<>(SB), NOSPLIT|NOFRAME, $0-0
+	PUSHQ BP
+	MOVQ SP, BP
+	MOVQ 0(DI), DI
+	CALL _onlygo_unsetenv(SB)
+	POPQ BP
+	RET
+
+TEXT cgo_nop<>(SB), NOSPLIT|NOFRAME, $0-0
+	RET
+`,
+	"arm64": `// _cgo_init(g0 *g, setg_gcc uintptr) saves setg_gcc and sets the
+// bottom of the stack of g0 to the bottom of the stack of the main thread.
+TEXT cgo_init<>(SB), NOSPLIT|NOFRAME, $0-0
+	SUB $112, RSP // R29, R30 and R19 at 0(RSP), pthread_attr_t at 32(RSP) and its stack size at 96(RSP)
+	MOVD R29, 0(RSP)
+	MOVD R30, 8(RSP)
+	MOVD R19, 16(RSP)
+	MOVD RSP, R29
+	MOVD R1, setg_gcc<>(SB)
+	MOVD R0, R19
+	ADD $32, RSP, R0
+	CALL _onlygo_pthread_attr_init(SB)
+	ADD $32, RSP, R0
+	ADD $96, RSP, R1
+	CALL _onlygo_pthread_attr_getstacksize(SB)
+	MOVD 96(RSP), R1
+	MOVD RSP, R0
+	SUB R1, R0
+	ADD $4096, R0 // a page above the stack size below RSP
+	MOVD R0, 0(R19) // g.stack.lo
+	ADD $32, RSP, R0
+	CALL _onlygo_pthread_attr_destroy(SB)
+	MOVD 16(RSP), R19
+	MOVD 8(RSP), R30
+	MOVD 0(RSP), R29
+	ADD $112, RSP
+	RET
+
+// _cgo_thread_start(ts *ThreadStart) creates a thread with pthread_create that
+// calls ts.fn with g set to ts.g. Every signal is blocked while it is created.
+TEXT cgo_thread_start<>(SB), NOSPLIT|NOFRAME, $0-0
+	SUB $384, RSP // R29, R30, R19, R20 and R21 at 0(RSP), pthread_attr_t at 48(RSP), its stack size at 112(RSP), pthread_t at 120(RSP) and two sigset_t at 128(RSP) and 256(RSP)
+	MOVD R29, 0(RSP)
+	MOVD R30, 8(RSP)
+	MOVD R19, 16(RSP)
+	MOVD R20, 24(RSP)
+	MOVD R21, 32(RSP)
+	MOVD RSP, R29
+	MOVD R0, R19
+	MOVD $24, R0 // the new thread frees the copy of ts
+	CALL _onlygo_malloc(SB)
+	CBZ R0, fail
+	MOVD 0(R19), R1
+	MOVD R1, 0(R0)
+	MOVD 8(R19), R1
+	MOVD R1, 8(R0)
+	MOVD 16(R19), R1
+	MOVD R1, 16(R0)
+	MOVD R0, R20
+	ADD $128, RSP, R0
+	CALL _onlygo_sigfillset(SB)
+	MOVD $2, R0 // SIG_SETMASK
+	ADD $128, RSP, R1
+	ADD $256, RSP, R2
+	CALL _onlygo_pthread_sigmask(SB)
+	ADD $48, RSP, R0
+	CALL _onlygo_pthread_attr_init(SB)
+	ADD $48, RSP, R0
+	ADD $112, RSP, R1
+	CALL _onlygo_pthread_attr_getstacksize(SB)
+	MOVD 0(R20), R1
+	MOVD 112(RSP), R2
+	MOVD R2, 8(R1) // g.stack.hi is the size until the thread knows where its stack is
+	ADD $120, RSP, R0
+	ADD $48, RSP, R1
+	MOVD $threadentry<>(SB), R2
+	MOVD R20, R3
+	CALL _onlygo_pthread_create(SB)
+	MOVD R0, R21
+	MOVD $2, R0
+	ADD $256, RSP, R1
+	MOVD $0, R2
+	CALL _onlygo_pthread_sigmask(SB)
+	ADD $48, RSP, R0
+	CALL _onlygo_pthread_attr_destroy(SB)
+	CBNZ R21, fail
+	MOVD 32(RSP), R21
+	MOVD 24(RSP), R20
+	MOVD 16(RSP), R19
+	MOVD 8(RSP), R30
+	MOVD 0(RSP), R29
+	ADD $384, RSP
+	RET
+fail:
+	CALL _onlygo_abort(SB)
+	RET
+
+// threadentry(ts *ThreadStart) is the start routine of every thread the runtime creates.
+TEXT threadentry<>(SB), NOSPLIT|NOFRAME, $0-0
+	SUB $32, RSP
+	MOVD R29, 0(RSP)
+	MOVD R30, 8(RSP)
+	MOVD RSP, R29
+	MOVD 0(R0), R19 // g
+	MOVD 16(R0), R20 // fn
+	CALL _onlygo_free(SB)
+	MOVD R19, R0
+	MOVD setg_gcc<>(SB), R1
+	CALL (R1)
+	CALL (R20) // doesn't return
+	CALL _onlygo_abort(SB)
+	RET
+
+// _cgo_setenv(arg *[2]*byte) calls setenv(arg[0], arg[1], 1)
+TEXT cgo_setenv<>(SB), NOSPLIT|NOFRAME, $0-0
+	SUB $16, RSP
+	MOVD R29, 0(RSP)
+	MOVD R30, 8(RSP)
+	MOVD RSP, R29
+	MOVD 8(R0), R1
+	MOVD 0(R0), R0
+	MOVD $1, R2
+	CALL _onlygo_setenv(SB)
+	MOVD 8(RSP), R30
+	MOVD 0(RSP), R29
+	ADD $16, RSP
+	RET
+
+// _cgo_unsetenv(arg *[1]*byte) calls unsetenv(arg[0])
+TEXT cgo_unsetenv<>(SB), NOSPLIT|NOFRAME, $0-0
+	SUB $16, RSP
+	MOVD R29, 0(RSP)
+	MOVD R30, 8(RSP)
+	MOVD RSP, R29
+	MOVD 0(R0), R0
+	CALL _onlygo_unsetenv(SB)
+	MOVD 8(RSP), R30
+	MOVD 0(RSP), R29
+	ADD $16, RSP
+	RET
+
+TEXT cgo_nop<>(SB), NOSPLIT|NOFRAME, $0-0
+	RET
+`,
+}
+
+// writeBootstrap writes the bootstrap of package pkg into dir for every GOARCH of linux.
+func writeBootstrap(dir, pkg string) {
+	var files = map[string]string{
+		"onlygo_bootstrap_linux.go":     fmt.Sprintf(bootstrapGo, pkg),
+		"onlygo_bootstrap_cgo_linux.go": fmt.Sprintf(bootstrapCgo, pkg),
+	}
+	for arch, asm := range bootstrapAsm {
+		files["onlygo_bootstrap_linux_"+arch+".s"] = "// File generated using onlygo. DO NOT EDIT!!!\n\n//go:build !cgo\n\n" +
+			"#include \"textflag.h\"\n" + bootstrapData + "\n" + asm
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -7,9 +7,57 @@ type FuncGen struct {
 	PostCall func()
 	MovInst  func(*Type)
 	RetInst  func(*Type)
-	GenCall  func(string, bool)
+	Resolve  func(string) // calls the Go resolve function if the address isn't set yet
+	Acquire  func(string) // counts the call as in flight or calls the closed function if the libraries aren't loaded
+	Release  func(string) // stops counting the call as in flight
+
+	// StackCall calls the C function at the address in the argument fn if it isn't nil,
+	// the address saved by SaveContext if name is empty, the address resolved for name
+	// if dlResolve is set and the symbol imported with cgo_import_dynamic through
+	// <name>_jmp otherwise. It is called by StackHelper on the
+	// stack whose top is in the argument stack or, if stack is nil, below the stack
+	// pointer of the wrapper.
+	StackCall   func(stack, fn *Type, name string, dlResolve bool)
+	StackHelper func() // writes the function that switches to the stack and calls the C function
+
+	// SystemCall calls the C function like StackCall but on the system stack of the thread.
+	// It records the call in the frame of the wrapper, which is systemFrame bytes, and
+	// passes it to runtime.asmcgocall with the function written by SystemHelper. If errno
+	// is set, the helper also clears errno before the call and SystemErrno stores it after.
+	SystemCall   func(fn *Type, name string, dlResolve, errno bool)
+	SystemHelper func()
+	SystemErrno  func(*Type)
+	Batch        func() // writes _onlygo_batch which makes the calls recorded by a Batch
+
+	// Jump loads the address of the C function of name like StackCall into the context
+	// register and jumps to the shared wrapper. SaveContext saves it in the wrapper's frame.
+	Jump        func(name, wrapper string, dlResolve bool)
+	SaveContext func()
+
+	// ClearErrno keeps the address of errno returned by the errno location function,
+	// which StackCall calls through _errno_jmp, and sets it to zero. Errno stores it
+	// in the result after the C function returns.
+	ClearErrno func()
+	Errno      func(*Type)
 }
 
+// the offsets of the fields of _onlygo_call that _onlygo_batch uses and its size
+const (
+	callFn     = 0
+	callInts   = 8
+	callFloats = callInts + 8*8
+	callRet    = callFloats + 8*8
+	callSize   = callRet + 4*8
+)
+
+// the offset of the _onlygo_call that SystemCall records in the frame of the wrapper,
+// the word after it with the errno location function and then errno and the size of the frame
+const (
+	systemCall  = 32
+	systemErrno = systemCall + callSize
+	systemFrame = systemErrno + 8
+)
+
 var generators = map[string]map[string]func(io.Writer, Function) FuncGen{
 	"darwin": {
 		"arm64": newArm64FuncGen,
@@ -23,3 +71,55 @@ var generators = map[string]map[string]func(io.Writer, Function) FuncGen{
 		"amd64": newAmd64FuncGen,
 	},
 }
+
+// rtld is the value of each flag of dlopen on each GOOS
+var rtld = map[string]map[string]int{
+	"darwin": {"lazy": 0x1, "now": 0x2, "local": 0x4, "global": 0x8, "nodelete": 0x80},
+	"ios":    {"lazy": 0x1, "now": 0x2, "local": 0x4, "global": 0x8, "nodelete": 0x80},
+	"linux":  {"lazy": 0x1, "now": 0x2, "local": 0x0, "global": 0x100, "nodelete": 0x1000, "deepbind": 0x8},
+}
+
+// memfdCreate is the number of the memfd_create syscall on each GOARCH of linux
+var memfdCreate = map[string]int{
+	"amd64": 319,
+	"arm64": 279,
+}
+
+// libraryPath is where the dynamic loader of each GOOS and GOARCH looks for
+// a library that is opened by name
+var libraryPath = map[string]map[string][]string{
+	"darwin": {
+		"arm64": {"/usr/local/lib", "/usr/lib"},
+		"amd64": {"/usr/local/lib", "/usr/lib"},
+	},
+	"ios": {
+		"arm64": {"/usr/lib"},
+	},
+	"linux": {
+		"arm64": {"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu", "/lib64", "/usr/lib64", "/lib", "/usr/lib", "/usr/local/lib"},
+		"amd64": {"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu", "/lib64", "/usr/lib64", "/lib", "/usr/lib", "/usr/local/lib"},
+	},
+}
+
+// libraryPathEnv is the environment variable that adds directories to
+// search before libraryPath on each GOOS
+var libraryPathEnv = map[string]string{
+	"darwin": "DYLD_LIBRARY_PATH",
+	"ios":    "DYLD_LIBRARY_PATH",
+	"linux":  "LD_LIBRARY_PATH",
+}
+
+// errnoLocation is the function that returns the address of errno of the
+// calling thread on each GOOS and the library it is imported from
+var errnoLocation = map[string][2]string{
+	"darwin": {"__error", "/usr/lib/libSystem.B.dylib"},
+	"ios":    {"__error", "/usr/lib/libSystem.B.dylib"},
+	"linux":  {"__errno_location", "libc.so.6"},
+}
+
+// libdlPath is the library that dlopen and dlsym are imported from on each GOOS
+var libdlPath = map[string]string{
+	"darwin": "/usr/lib/libSystem.B.dylib",
+	"ios":    "/usr/lib/libSystem.B.dylib",
+	"linux":  "libdl.so.2",
+}
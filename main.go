@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"go/ast"
 	"go/format"
@@ -10,6 +12,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -41,14 +46,59 @@ type Type struct {
 	fields         []*Type // used only if kind == STRUCT
 	length         int     // only used if kind == ARRAY
 	padding        int     // any padding this type receives
+	offset         int     // offset from FP in the Go argument frame
+	typ            string  // the Go type as written; only set for the arguments of a stub
 }
 
 type Function struct {
 	name     string  // name of the Go func
 	linkname string  // name to link to
+	version  string  // the ELF symbol version to link to if any
 	sig      string  // the signature as written in go
 	args     []*Type // the arguments to the func
 	ret      *Type   // what if anything it returns
+	argSize  int     // size in bytes of the arguments and results
+	optional bool    // the symbol may be missing from the shared object
+	lib      string  // the name of the library to resolve from; empty for the default library
+	indirect bool    // the address of the C function is passed in the first argument
+	queue    string  // the queue of threads its calls are made by; empty if it is called directly
+	stack    bool    // the C function is called on the stack whose top is passed in the first argument
+	async    bool    // it also has a variant that returns a channel instead of waiting
+	result   string  // the Go type of the result; empty if it has none
+	fast     bool    // the call doesn't tell the scheduler that it is in a system call
+	shared   bool    // the address of the C function is passed in the context register
+	errno    *Type   // the syscall.Errno result that errno is returned in; nil if it isn't
+	check    string  // how the result reports a failure to the variant that returns an error; empty if it has none
+	describe string  // the Go name of the function that describes the error code; empty if there is none
+}
+
+// Library is a shared object opened on one GOOS and GOARCH
+type Library struct {
+	paths     []string   // the candidates that are tried in order until one opens
+	env       string     // the environment variable that overrides paths if it's set
+	wildcards int        // the number of wildcards in the directive that declared it
+	preload   [][]string // the dependencies that are opened in order before the library
+	embed     []string   // the embedded files that are opened in order; the last is the library
+	sha256    []string   // the hex encoded SHA-256 sums that the file of the library may have
+}
+
+// Stub is what the package wide functions need to know about a generated stub file
+type Stub struct {
+	dir           string      // the directory of the stub file
+	pkg           string      // the package of the stub file
+	fileNameNoExt string      // the prefix of the per file identifiers
+	init          bool        // it has an init function; it doesn't if it uses //onlygo:resolve_with_cgo
+	optional      bool        // it uses ErrUnavailable
+	checksum      bool        // it uses ErrChecksum
+	unload        bool        // it has a close function and uses ErrClosed
+	library       bool        // it has the Library type
+	bootstrap     bool        // the package needs the bootstrap that initializes libc on linux
+	queues        bool        // some functions are called by the threads of a queue
+	mainthread    bool        // some functions are called on the main thread
+	groups        []string    // the groups of //onlygo:threadaffine
+	batch         bool        // some functions have a method on Batch
+	errors        bool        // some functions have a variant that returns a *CallError
+	platforms     [][2]string // the GOOS and GOARCH pairs that the wrappers are written for
 }
 
 func main() {
@@ -56,10 +106,80 @@ func main() {
 		log.Fatal("no files specified")
 		return
 	}
-	var files = os.Args[1:]
+	if os.Args[1] == "sha256" {
+		sha256Command(os.Args[2:])
+		return
+	}
+	generateFiles(os.Args[1:])
+}
+
+// generateFiles generates the stub files fileNames and writes the package files
+// of their directories.
+func generateFiles(fileNames []string) {
+	var stubs = make(map[string]map[string]Stub) // the directory -> the cleaned path -> the stub file
+	var dirs []string
+	for _, fileName := range fileNames {
+		stub := generate(fileName)
+		if _, ok := stubs[stub.dir]; !ok {
+			dirs = append(dirs, stub.dir)
+			stubs[stub.dir] = make(map[string]Stub)
+		}
+		stubs[stub.dir][filepath.Clean(fileName)] = stub
+	}
+	for _, dir := range dirs {
+		// the package files are written from every stub file of the package in the
+		// same order even if they are generated by separate go:generate lines
+		var all []Stub
+		for _, fileName := range stubFiles(dir) {
+			stub, ok := stubs[dir][fileName]
+			if !ok {
+				stub = generate(fileName)
+			}
+			delete(stubs[dir], fileName)
+			all = append(all, stub)
+		}
+		var rest []string // the files that don't look like stubs
+		for fileName := range stubs[dir] {
+			rest = append(rest, fileName)
+		}
+		sort.Strings(rest)
+		for _, fileName := range rest {
+			all = append(all, stubs[dir][fileName])
+		}
+		writePackage(all)
+	}
+}
+
+// stubFiles returns the paths of the Go files in dir that have onlygo directives
+// in the order of their names. Test files and generated files are skipped.
+func stubFiles(dir string) (paths []string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range entries {
+		var name = e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if bytes.HasPrefix(data, []byte("// File generated using onlygo.")) || !bytes.Contains(data, []byte("//onlygo:")) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths
+}
+
+// generate writes the wrappers, shared object declarations and init
+// function of the stub file fileName.
+func generate(fileName string) (stub Stub) {
 	fs := token.NewFileSet()
-	var fileName = files[0]
-	var fileNameNoExt = fileName[:strings.IndexRune(fileName, '.')]
+	var pathNoExt = strings.TrimSuffix(fileName, filepath.Ext(fileName)) // the generated files are named after it
+	var fileNameNoExt = filepath.Base(pathNoExt)                         // the per file identifiers start with it
 	open, err := os.Open(fileName)
 	if err != nil {
 		panic(err)
@@ -73,29 +193,200 @@ func main() {
 		panic(err)
 	}
 	var package_ = file.Name.Name
-	var functions []Function                      // the functions to generate
-	var libs = make(map[string]map[string]string) // the os -> arch -> shared object file
-	var resolveWithDL = true                      // default is true; otherwise it uses cgo_import_dynamic directive
+	var functions []Function                                   // the functions to generate
+	var libs = make(map[string]map[string]map[string]*Library) // the os -> arch -> library name -> shared object
+	var libNames []string                                      // the library names in the order they were declared; "" is the default library
+	var resolveWithDL = true                                   // default is true; otherwise it uses cgo_import_dynamic directive
+	var lazy bool                                              // resolve each function the first time it is called
+	var libFlags = make(map[string][]string)                   // the library name -> flags passed to dlopen
+	var dlopenText = make(map[string]string)                   // the library name -> the //onlygo:dlopen directive of it
+	var hasEmbeds bool                                         // some library is embedded in the binary
+	var hasHashes bool                                         // some library is verified before it is opened
+	var library bool                                           // generate the Library type that can be opened more than once
+	var unload bool                                            // generate Close which waits for calls in flight and closes the libraries
+	var autoinit string                                        // what the package init function does if Init fails; empty if it doesn't call Init
+	var builtinDL bool                                         // call dlopen and dlsym directly instead of through the dl package
+	var bootstrap bool                                         // create the threads of the runtime with pthread_create on linux
+	var workers = 4                                            // the number of worker threads if a function uses them
+	var batch bool                                             // generate the methods of Batch that record calls
+	var shapes bool                                            // functions with the same arguments and result share one wrapper
 	for _, cg := range file.Comments {
 		for _, c := range cg.List {
 			switch {
 			case strings.EqualFold(c.Text, "//onlygo:resolve_with_cgo"):
 				resolveWithDL = false
+			case strings.EqualFold(c.Text, "//onlygo:lazy"):
+				lazy = true
+			case strings.EqualFold(c.Text, "//onlygo:library"):
+				library = true
+			case strings.EqualFold(c.Text, "//onlygo:unload"):
+				unload = true
+			case strings.EqualFold(c.Text, "//onlygo:builtin_dl"):
+				builtinDL = true
+			case strings.EqualFold(c.Text, "//onlygo:bootstrap"):
+				bootstrap = true
+			case strings.EqualFold(c.Text, "//onlygo:batch"):
+				batch = true
+			case strings.EqualFold(c.Text, "//onlygo:shapes"):
+				shapes = true
+			case strings.HasPrefix(c.Text, "//onlygo:workers"):
+				// //onlygo:workers N
+				args := strings.Fields(c.Text)
+				if n, err := strconv.Atoi(args[len(args)-1]); len(args) == 2 && err == nil && n > 0 {
+					workers = n
+				} else {
+					log.Printf("incorrect format GOT %s WANT //onlygo:workers N\n", c.Text)
+				}
+			case strings.HasPrefix(c.Text, "//onlygo:autoinit"):
+				// //onlygo:autoinit [panic|record]
+				switch args := strings.Fields(c.Text); {
+				case len(args) == 1:
+					autoinit = "panic"
+				case len(args) == 2 && (args[1] == "panic" || args[1] == "record"):
+					autoinit = args[1]
+				default:
+					log.Printf("incorrect format GOT %s WANT //onlygo:autoinit [panic|record]\n", c.Text)
+				}
 			case strings.HasPrefix(c.Text, "//onlygo:open"):
-				args := strings.Split(c.Text, " ")
-				if len(args) != 4 {
-					log.Printf("incorrect format GOT %s WANT //onlygo:open GOOS GOARCH LIB\n", c.Text)
+				// //onlygo:open GOOS GOARCH LIB[,LIB...] [NAME] [env=VAR]
+				args := strings.Fields(c.Text)
+				if len(args) < 4 {
+					log.Printf("incorrect format GOT %s WANT //onlygo:open GOOS GOARCH LIB[,LIB...] [NAME] [env=VAR]\n", c.Text)
+					continue
+				}
+				var name string
+				var lib = &Library{paths: strings.Split(args[3], ",")}
+				for _, opt := range args[4:] {
+					switch {
+					case strings.HasPrefix(opt, "env="):
+						lib.env = strings.TrimPrefix(opt, "env=")
+					case strings.ContainsRune(opt, '='):
+						log.Printf("unknown option %s in %s\n", opt, c.Text)
+					default:
+						name = opt
+					}
+				}
+				for _, arg := range args[1:3] {
+					if arg == "*" {
+						lib.wildcards++
+					}
+				}
+				for _, p := range platforms(args[1], args[2]) {
+					system, arch := p[0], p[1]
+					archs := libs[system]
+					if archs == nil {
+						archs = make(map[string]map[string]*Library)
+						libs[system] = archs
+					}
+					names := archs[arch]
+					if names == nil {
+						names = make(map[string]*Library)
+						archs[arch] = names
+					}
+					// a directive without wildcards overrides one with them
+					if prev, ok := names[name]; !ok || lib.wildcards <= prev.wildcards {
+						var l = *lib // each platform gets its own copy to add dependencies to
+						names[name] = &l
+					}
+				}
+				var declared bool
+				for _, n := range libNames {
+					declared = declared || n == name
+				}
+				if !declared {
+					libNames = append(libNames, name)
+				}
+			case strings.HasPrefix(c.Text, "//onlygo:dlopen"):
+				// //onlygo:dlopen FLAG... [NAME]
+				var name string
+				var flags []string
+				for _, arg := range strings.Fields(c.Text)[1:] {
+					if _, ok := rtld["linux"][arg]; ok { // linux has every flag
+						flags = append(flags, arg)
+					} else if name == "" {
+						name = arg
+					} else {
+						log.Fatalf("%s names more than one library", c.Text)
+					}
+				}
+				libFlags[name] = flags
+				dlopenText[name] = c.Text
+			}
+		}
+	}
+	// the name is checked once every library has been declared so that a misspelled flag isn't taken for it
+	for name, text := range dlopenText {
+		var declared = name == ""
+		for _, n := range libNames {
+			declared = declared || n == name
+		}
+		if !declared {
+			log.Fatalf("%s: %s is neither a flag of dlopen nor a library declared with //onlygo:open", text, name)
+		}
+	}
+	// the dependencies, embedded files and hashes are added once every library has been declared
+	for _, cg := range file.Comments {
+		for _, c := range cg.List {
+			var isEmbed = strings.HasPrefix(c.Text, "//onlygo:embed")
+			var isHash = strings.HasPrefix(c.Text, "//onlygo:sha256")
+			if !strings.HasPrefix(c.Text, "//onlygo:preload") && !isEmbed && !isHash {
+				continue
+			}
+			// //onlygo:preload GOOS GOARCH LIB[,LIB...] [NAME]
+			// //onlygo:embed GOOS GOARCH FILE[,FILE...] [NAME]
+			// //onlygo:sha256 GOOS GOARCH HEX[,HEX...] [NAME]
+			args := strings.Fields(c.Text)
+			if len(args) != 4 && len(args) != 5 {
+				log.Printf("incorrect format GOT %s WANT %s GOOS GOARCH LIB[,LIB...] [NAME]\n", c.Text, args[0])
+				continue
+			}
+			if isHash {
+				var valid = true
+				for _, sum := range strings.Split(args[3], ",") {
+					if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+						log.Printf("%s is not a hex encoded SHA-256 in %s\n", sum, c.Text)
+						valid = false
+					}
+				}
+				if !valid {
+					continue
+				}
+			}
+			var name string
+			if len(args) == 5 {
+				name = args[4]
+			}
+			for _, p := range platforms(args[1], args[2]) {
+				lib, ok := libs[p[0]][p[1]][name]
+				if !ok && isEmbed { // an embedded library doesn't need to be opened from a path
+					lib = &Library{}
+					if libs[p[0]] == nil {
+						libs[p[0]] = make(map[string]map[string]*Library)
+					}
+					if libs[p[0]][p[1]] == nil {
+						libs[p[0]][p[1]] = make(map[string]*Library)
+					}
+					libs[p[0]][p[1]][name] = lib
+					var declared bool
+					for _, n := range libNames {
+						declared = declared || n == name
+					}
+					if !declared {
+						libNames = append(libNames, name)
+					}
+				} else if !ok {
+					log.Printf("library %q has no //onlygo:open directive for (%s, %s) to apply %s to\n", name, p[0], p[1], c.Text)
 					continue
 				}
-				system := args[1]
-				arch := args[2]
-				lib := args[3]
-				archs := libs[system]
-				if archs == nil {
-					archs = make(map[string]string)
-					libs[system] = archs
+				if isEmbed {
+					lib.embed = append(lib.embed, strings.Split(args[3], ",")...)
+					hasEmbeds = true
+				} else if isHash {
+					lib.sha256 = append(lib.sha256, strings.Split(args[3], ",")...)
+					hasHashes = true
+				} else {
+					lib.preload = append(lib.preload, strings.Split(args[3], ","))
 				}
-				archs[arch] = lib
 			}
 		}
 	}
@@ -107,8 +398,18 @@ func main() {
 			}
 			var (
 				name, linkname, sig string
+				version             string
 				args                []*Type
 				ret                 *Type
+				optional            bool
+				lib                 string
+				queue               string
+				async               bool
+				result              string
+				fast                bool
+				errno               *Type
+				returnsErrno        bool
+				check, describe     string
 			)
 			{
 				typ := n.Type
@@ -119,11 +420,68 @@ func main() {
 					comments = n.Doc.List
 				}
 				for _, c := range comments {
-					if !strings.HasPrefix(c.Text, "//onlygo:linkname") {
-						continue
+					switch {
+					case strings.HasPrefix(c.Text, "//onlygo:linkname"):
+						linkname = strings.Split(c.Text, " ")[1]
+						if i := strings.IndexRune(linkname, '@'); i >= 0 { // symbol@VERSION
+							version = linkname[i+1:]
+							linkname = linkname[:i]
+						}
+					case strings.EqualFold(c.Text, "//onlygo:optional"):
+						optional = true
+					case strings.HasPrefix(c.Text, "//onlygo:lib "):
+						lib = strings.TrimSpace(strings.TrimPrefix(c.Text, "//onlygo:lib "))
+					case c.Text == "//onlygo:fastcall":
+						fast = true
+					case c.Text == "//onlygo:errno":
+						returnsErrno = true
+					case strings.HasPrefix(c.Text, "//onlygo:error "):
+						// //onlygo:error nonzero|negative|null|status[=FUNC]
+						var args = strings.SplitN(strings.TrimSpace(strings.TrimPrefix(c.Text, "//onlygo:error ")), "=", 2)
+						switch args[0] {
+						case "nonzero", "negative", "null", "status":
+						default:
+							log.Printf("incorrect format GOT %s WANT //onlygo:error nonzero|negative|null|status[=FUNC]\n", c.Text)
+							continue
+						}
+						check, describe = args[0], ""
+						if len(args) == 2 {
+							describe = args[1]
+						}
+					case c.Text == "//onlygo:worker" || strings.HasPrefix(c.Text, "//onlygo:worker "),
+						c.Text == "//onlygo:mainthread" || strings.HasPrefix(c.Text, "//onlygo:mainthread "),
+						strings.HasPrefix(c.Text, "//onlygo:threadaffine "):
+						// //onlygo:worker [async]
+						// //onlygo:mainthread [async]
+						// //onlygo:threadaffine GROUP [async]
+						var args = strings.Fields(c.Text)
+						var q string
+						switch args[0] {
+						case "//onlygo:worker":
+							q = "_" + fileNameNoExt + "_workers"
+						case "//onlygo:mainthread":
+							q = "_onlygo_mainthread"
+						default:
+							if !token.IsIdentifier(args[1]) {
+								log.Printf("the group %s in %s isn't an identifier\n", args[1], c.Text)
+								continue
+							}
+							q = "_onlygo_affine_" + args[1]
+							args = args[1:]
+						}
+						switch {
+						case len(args) == 1:
+						case len(args) == 2 && args[1] == "async":
+							async = true
+						default:
+							log.Printf("incorrect format GOT %s WANT %s [async]\n", c.Text, args[0])
+							continue
+						}
+						if queue != "" && queue != q {
+							log.Fatalf("%s can only use one of //onlygo:worker, //onlygo:mainthread and //onlygo:threadaffine", name)
+						}
+						queue = q
 					}
-					linkname = strings.Split(c.Text, " ")[1]
-					break
 				}
 				n.Doc = nil // remove the comments so it doesn't interfere with printing the func sig
 				var sigW = &strings.Builder{}
@@ -136,37 +494,412 @@ func main() {
 					for _, n := range v.Names {
 						ty := getType(v.Type)
 						ty.name = n.Name
+						var typW = &strings.Builder{}
+						_ = format.Node(typW, fs, v.Type)
+						ty.typ = typW.String()
 						args = append(args, ty)
 					}
 				}
-				if typ.Results != nil && len(typ.Results.List) == 1 {
-					ret = getType(typ.Results.List[0].Type)
+				var results []ast.Expr
+				var resultNames []string // the names that go vet expects the assembly to use
+				if typ.Results != nil {
+					for _, field := range typ.Results.List {
+						if len(field.Names) == 0 {
+							results = append(results, field.Type)
+							resultNames = append(resultNames, "")
+						}
+						for _, n := range field.Names {
+							results = append(results, field.Type)
+							resultNames = append(resultNames, n.Name)
+						}
+					}
+				}
+				for i := range resultNames {
+					if resultNames[i] == "" && i == 0 {
+						resultNames[i] = "ret"
+					} else if resultNames[i] == "" {
+						resultNames[i] = fmt.Sprintf("ret%d", i)
+					}
+				}
+				if returnsErrno {
+					var last = &strings.Builder{}
+					if len(results) > 0 {
+						_ = format.Node(last, fs, results[len(results)-1])
+					}
+					if last.String() != "syscall.Errno" {
+						log.Fatalf("%s must return syscall.Errno as its last result to use //onlygo:errno", name)
+					}
+					errno = &Type{name: resultNames[len(results)-1], kind: PTR}
+					results, resultNames = results[:len(results)-1], resultNames[:len(results)-1]
+				}
+				if len(results) == 1 {
+					ret = getType(results[0])
+					ret.name = resultNames[0]
+					var resultW = &strings.Builder{}
+					_ = format.Node(resultW, fs, results[0])
+					result = resultW.String()
 				} else {
 					ret = &Type{}
 				}
 			}
-			functions = append(functions, Function{
-				name, linkname, sig, args, ret,
-			})
+			fn := Function{
+				name: name, linkname: linkname, version: version, sig: sig, args: args, ret: ret, optional: optional, lib: lib,
+				queue: queue, async: async, result: result, fast: fast, errno: errno,
+				check: check, describe: describe,
+			}
+			if errno != nil && queue != "" {
+				log.Fatalf("%s is called by a queue of threads so it can't use //onlygo:errno", name)
+			}
+			if fast && queue != "" {
+				log.Fatalf("%s can't use //onlygo:fastcall with a thread of a queue", name)
+			}
+			fn.argSize = layout(fn)
+			functions = append(functions, fn)
 		}
 		return true
 	})
+	for _, f := range functions {
+		if f.fast {
+			log.Printf("%s: the program must be linked with -ldflags=-checklinkname=0 to call runtime.asmcgocall for //onlygo:fastcall\n", fileName)
+			break
+		}
+	}
+	for _, f := range functions {
+		var declared bool
+		for _, n := range libNames {
+			declared = declared || n == f.lib
+		}
+		if !declared {
+			log.Fatalf("%s uses the library %q which has no //onlygo:open directive", f.name, f.lib)
+		}
+	}
+	var hasVersions, hasErrno, hasErrors bool
+	for i, f := range functions {
+		hasVersions = hasVersions || f.version != ""
+		hasErrno = hasErrno || f.errno != nil
+		hasErrors = hasErrors || f.check != ""
+		if f.check != "" {
+			functions[i].describe = checkError(f, functions)
+		}
+	}
+	if library && !resolveWithDL {
+		log.Fatal("//onlygo:library can't be used with //onlygo:resolve_with_cgo")
+	}
+	if library && len(libNames) > 1 {
+		log.Fatal("//onlygo:library can only be used with a single library")
+	}
+	if unload && (!resolveWithDL || lazy) {
+		log.Fatal("//onlygo:unload can't be used with //onlygo:resolve_with_cgo or //onlygo:lazy")
+	}
+	if builtinDL && !resolveWithDL {
+		log.Fatal("//onlygo:builtin_dl can't be used with //onlygo:resolve_with_cgo")
+	}
+	if batch && unload {
+		log.Fatal("//onlygo:batch can't be used with //onlygo:unload")
+	}
+	if shapes && lazy {
+		log.Fatal("//onlygo:shapes can't be used with //onlygo:lazy")
+	}
+	// the functions of libdl that are called directly if builtinDL is set.
+	// They are called on the stack whose top is passed in _stack.
+	var libdl = []Function{
+		{name: "_" + fileNameNoExt + "_libdl_dlopen", linkname: "dlopen", sig: "func _" + fileNameNoExt + "_libdl_dlopen(_stack uintptr, path *byte, mode int32) uintptr",
+			args: []*Type{{name: "_stack", kind: PTR}, {name: "path", kind: PTR}, {name: "mode", kind: I32}}, ret: &Type{kind: PTR}, stack: true},
+		{name: "_" + fileNameNoExt + "_libdl_dlsym", linkname: "dlsym", sig: "func _" + fileNameNoExt + "_libdl_dlsym(_stack uintptr, handle uintptr, symbol *byte) uintptr",
+			args: []*Type{{name: "_stack", kind: PTR}, {name: "handle", kind: PTR}, {name: "symbol", kind: PTR}}, ret: &Type{kind: PTR}, stack: true},
+		{name: "_" + fileNameNoExt + "_libdl_dlerror", linkname: "dlerror", sig: "func _" + fileNameNoExt + "_libdl_dlerror(_stack uintptr) *byte",
+			args: []*Type{{name: "_stack", kind: PTR}}, ret: &Type{kind: PTR}, stack: true},
+		{name: "_" + fileNameNoExt + "_libdl_dlclose", linkname: "dlclose", sig: "func _" + fileNameNoExt + "_libdl_dlclose(_stack uintptr, handle uintptr) int32",
+			args: []*Type{{name: "_stack", kind: PTR}, {name: "handle", kind: PTR}}, ret: &Type{kind: I32}, stack: true},
+	}
+	for i := range libdl {
+		libdl[i].argSize = layout(libdl[i])
+	}
+	// dlOpen opens a library and returns a value of dlLib that has the Lookup and Close methods
+	var dlOpen, dlLib = "dl.Open", "*dl.Lib"
+	if builtinDL {
+		dlOpen, dlLib = "_"+fileNameNoExt+"_dlOpen", "*_"+fileNameNoExt+"_lib"
+	}
+	var hasQueues, hasWorkers, hasAffine bool
+	var mainthread bool
+	var groups []string
+	for _, f := range functions {
+		hasQueues = hasQueues || f.queue != ""
+		hasWorkers = hasWorkers || f.queue == "_"+fileNameNoExt+"_workers"
+		mainthread = mainthread || f.queue == "_onlygo_mainthread"
+		if strings.HasPrefix(f.queue, "_onlygo_affine_") {
+			hasAffine = true
+			groups = append(groups, strings.TrimPrefix(f.queue, "_onlygo_affine_"))
+		}
+	}
+	if !bootstrap && (builtinDL || hasWorkers || hasAffine || hasErrno) { // dlerror, errno and the threads of the queues need threads created by pthread
+		log.Printf("%s: add //onlygo:bootstrap for //onlygo:builtin_dl, //onlygo:errno and the queues of threads to work without cgo on linux\n", fileName)
+	}
+	stub = Stub{
+		dir:           filepath.Dir(fileName),
+		pkg:           package_,
+		fileNameNoExt: fileNameNoExt,
+		init:          resolveWithDL,
+		checksum:      hasHashes,
+		unload:        unload,
+		library:       library,
+		bootstrap:     bootstrap,
+		queues:        hasQueues,
+		mainthread:    mainthread,
+		groups:        groups,
+		batch:         batch,
+		errors:        hasErrors,
+	}
+	for sys, archs := range libs {
+		for arch := range archs {
+			if _, ok := generators[sys][arch]; ok {
+				stub.platforms = append(stub.platforms, [2]string{sys, arch})
+			}
+		}
+	}
+	for _, f := range functions {
+		stub.optional = stub.optional || (f.optional && resolveWithDL)
+	}
+	// versioned symbols are looked up with dlvsym which is called through its own wrapper
+	var dlvsym = Function{
+		name:     "_" + fileNameNoExt + "_dlvsym",
+		linkname: "dlvsym",
+		sig:      "func _" + fileNameNoExt + "_dlvsym(_stack uintptr, handle uintptr, symbol *byte, version *byte) uintptr",
+		args:     []*Type{{name: "_stack", kind: PTR}, {name: "handle", kind: PTR}, {name: "symbol", kind: PTR}, {name: "version", kind: PTR}},
+		stack:    true,
+		ret:      &Type{kind: PTR},
+	}
+	dlvsym.argSize = layout(dlvsym)
 	var buf = &bytes.Buffer{}
 	for sys, archs := range libs {
-		for arch, lib := range archs {
-			create, err := os.Create(fileNameNoExt + "_so_" + sys + "_" + arch + ".go")
-			if err != nil {
-				panic(err)
+		for arch, names := range archs {
+			// every library must be declared for each GOOS and GOARCH
+			for _, name := range libNames {
+				if _, ok := names[name]; !ok {
+					log.Fatalf("library %q has no //onlygo:open directive for (%s, %s)", name, sys, arch)
+				}
+				if len(names[name].embed) > 0 && len(names[name].sha256) > 0 {
+					log.Fatalf("library %q is embedded on (%s, %s) so it can't be verified with //onlygo:sha256", name, sys, arch)
+				}
 			}
-			_, _ = create.WriteString(fmt.Sprintf("package %s\n\n", package_))
+			buf.Reset()
+			buf.WriteString(fmt.Sprintf("package %s\n\n", package_))
 			if resolveWithDL {
-				_, _ = create.WriteString(fmt.Sprintf("const _%s_SharedObject = \"%s\"\n", fileNameNoExt, lib))
+				var imports []string
+				if hasVersions && sys == "linux" {
+					imports = append(imports, "fmt")
+				}
+				if hasVersions && !builtinDL { // the type of the library that symbols are looked up in
+					imports = append(imports, "github.com/totallygamerjet/dl")
+				}
+				if hasVersions && sys == "linux" && !builtinDL { // libdl is looked up once
+					imports = append(imports, "sync")
+				}
+				if hasEmbeds && sys == "linux" {
+					imports = append(imports, "embed", "fmt", "os", "syscall", "unsafe")
+				} else if hasEmbeds {
+					imports = append(imports, "embed", "os", "path/filepath")
+				}
+				writeImports(buf, imports...)
+				if hasHashes {
+					buf.WriteString(fmt.Sprintf("\nvar _%s_LibraryPath = %#v\n", fileNameNoExt, libraryPath[sys][arch]))
+					buf.WriteString(fmt.Sprintf("\nconst _%s_LibraryPathEnv = \"%s\"\n", fileNameNoExt, libraryPathEnv[sys]))
+				}
+				for _, name := range libNames {
+					var ident = libIdent(fileNameNoExt, name)
+					buf.WriteString(fmt.Sprintf("\nvar %s_SharedObjects = %#v\n", ident, names[name].paths))
+					buf.WriteString(fmt.Sprintf("\nconst %s_SharedObjectEnv = \"%s\"\n", ident, names[name].env))
+					flags, comment := dlopenFlags(sys, libFlags[name])
+					buf.WriteString(fmt.Sprintf("\nconst %s_SharedObjectFlags = %#x // %s\n", ident, flags, comment))
+					buf.WriteString(fmt.Sprintf("\nvar %s_SharedObjectPreload = %#v\n", ident, names[name].preload))
+					if hasEmbeds {
+						buf.WriteString(fmt.Sprintf("\nvar %s_SharedObjectEmbed = %#v\n", ident, names[name].embed))
+						if len(names[name].embed) > 0 {
+							buf.WriteString(fmt.Sprintf("\n//go:embed %s", strings.Join(names[name].embed, " ")))
+						}
+						buf.WriteString(fmt.Sprintf("\nvar %s_SharedObjectFS embed.FS\n", ident))
+					}
+					if hasHashes {
+						buf.WriteString(fmt.Sprintf("\nvar %s_SharedObjectSHA256 = %#v\n", ident, names[name].sha256))
+					}
+				}
+				if hasEmbeds && sys == "linux" {
+					buf.WriteString(fmt.Sprintf(`
+// _%[1]s_embedFile copies data into an anonymous file created with memfd_create
+// and returns a path that it can be opened from and a function to call once it
+// is opened. The file stays open so that the descriptor isn't reused by another
+// library, whose path would then be the same.
+func _%[1]s_embedFile(name string, data []byte) (string, func(), error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", nil, err
+	}
+	fd, _, errno := syscall.Syscall(%[2]d, uintptr(unsafe.Pointer(p)), 1, 0) // memfd_create(name, MFD_CLOEXEC)
+	if errno != 0 {
+		return "", nil, os.NewSyscallError("memfd_create", errno)
+	}
+	for len(data) > 0 {
+		n, err := syscall.Write(int(fd), data)
+		if err != nil {
+			_ = syscall.Close(int(fd))
+			return "", nil, os.NewSyscallError("write", err)
+		}
+		data = data[n:]
+	}
+	return fmt.Sprintf("/proc/self/fd/%%d", fd), func() {}, nil
+}
+`, fileNameNoExt, memfdCreate[arch]))
+				} else if hasEmbeds {
+					buf.WriteString(fmt.Sprintf(`
+// _%[1]s_embedFile writes data to a file in a new private temporary
+// directory and returns its path and a function that removes the directory
+// once the file is opened.
+func _%[1]s_embedFile(name string, data []byte) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "onlygo")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { _ = os.RemoveAll(dir) }
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0700); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return path, remove, nil
+}
+`, fileNameNoExt))
+				}
+				if builtinDL {
+					// the functions are imported from libdl and called through trampolines in the assembly
+					buf.WriteString(fmt.Sprintf("\n//go:cgo_import_dynamic _ _ \"%s\"\n", libdlPath[sys]))
+					for _, f := range libdl {
+						buf.WriteString(fmt.Sprintf("//go:cgo_import_dynamic %s_sym %s \"%s\"\n", f.name, f.linkname, libdlPath[sys]))
+					}
+					if hasVersions && sys == "linux" {
+						buf.WriteString(fmt.Sprintf("//go:cgo_import_dynamic %s_sym %s \"%s\"\n", dlvsym.name, dlvsym.linkname, libdlPath[sys]))
+					}
+				}
+				if hasVersions && sys == "linux" && !builtinDL {
+					// dlvsym and the functions that find the handle of an open library are looked up
+					// the first time they're needed
+					buf.WriteString(fmt.Sprintf(`
+// %[2]s calls dlopen and is implemented in %[1]s_%[5]s_%[6]s.s
+%[3]s
+
+// %[7]s calls dlclose and is implemented in %[1]s_%[5]s_%[6]s.s
+%[4]s
+
+var _%[2]s, _%[7]s uintptr
+
+// _%[1]s_libdl looks up the functions of libdl once and keeps the error.
+var _%[1]s_libdl struct {
+	once sync.Once
+	err  error
+}
+
+// _%[1]s_handle returns the handle of the library that lib opened from path.
+// The library is already open so dlopen only returns its handle and the reference
+// that it adds is dropped again.
+func _%[1]s_handle(_ *dl.Lib, path string) (uintptr, error) {
+	_%[1]s_libdl.once.Do(func() {
+		libdl, err := dl.Open("libdl.so.2", dl.ScopeGlobal)
+		if err != nil {
+			_%[1]s_libdl.err = err
+			return
+		}
+		for _, sym := range []struct {
+			name string
+			addr *uintptr
+		}{{"dlopen", &_%[2]s}, {"dlclose", &_%[7]s}, {"dlvsym", &_%[8]s}} {
+			if *sym.addr, err = libdl.Lookup(sym.name); err != nil {
+				_%[1]s_libdl.err = err
+				return
+			}
+		}
+	})
+	if _%[1]s_libdl.err != nil {
+		return 0, _%[1]s_libdl.err
+	}
+	stack := _%[1]s_lockStack()
+	defer _%[1]s_dlStack.Unlock()
+	handle := %[2]s(stack, &append([]byte(path), 0)[0], 0x5) // RTLD_LAZY | RTLD_NOLOAD
+	if handle == 0 {
+		return 0, fmt.Errorf("%%s: library isn't open", path)
+	}
+	%[7]s(stack, handle)
+	return handle, nil
+}
+`, fileNameNoExt, libdl[0].name, libdl[0].sig, libdl[3].sig, sys, arch, libdl[3].name, dlvsym.name))
+				} else if hasVersions && sys == "linux" {
+					buf.WriteString(fmt.Sprintf(`
+// _%[1]s_handle returns the handle of lib.
+func _%[1]s_handle(lib %[2]s, _ string) (uintptr, error) {
+	return lib.handle, nil
+}
+`, fileNameNoExt, dlLib))
+				}
+				if hasVersions && sys == "linux" {
+					buf.WriteString(fmt.Sprintf(`
+// %[5]s calls dlvsym and is implemented in %[1]s_%[3]s_%[4]s.s
+%[2]s
+
+var _%[5]s uintptr
+
+// _%[1]s_lookupVersion looks up the given version of the symbol name
+// in the library that lib opened from path using dlvsym.
+func _%[1]s_lookupVersion(lib %[6]s, path, name, version string) (uintptr, error) {
+	handle, err := _%[1]s_handle(lib, path)
+	if err != nil {
+		return 0, err
+	}
+	stack := _%[1]s_lockStack()
+	defer _%[1]s_dlStack.Unlock()
+	addr := %[5]s(stack, handle, &append([]byte(name), 0)[0], &append([]byte(version), 0)[0])
+	if addr == 0 {
+		return 0, fmt.Errorf("%%s@%%s: symbol not found", name, version)
+	}
+	return addr, nil
+}
+`, fileNameNoExt, dlvsym.sig, sys, arch, dlvsym.name, dlLib))
+				} else if hasVersions {
+					buf.WriteString(fmt.Sprintf(`
+// _%[1]s_lookupVersion ignores version since symbol versions only exist on linux.
+func _%[1]s_lookupVersion(lib %[2]s, _, name, _ string) (uintptr, error) {
+	return lib.Lookup(name)
+}
+`, fileNameNoExt, dlLib))
+				}
 			} else {
+				for _, name := range libNames {
+					if len(names[name].embed) > 0 {
+						log.Fatalf("library %q can't be embedded when using //onlygo:resolve_with_cgo", name)
+					}
+					if len(names[name].paths) > 1 || names[name].env != "" {
+						log.Printf("only %s is linked to for (%s, %s) when using //onlygo:resolve_with_cgo", names[name].paths[0], sys, arch)
+					}
+					// the linker adds the library to DT_NEEDED on ELF platforms or LC_LOAD_DYLIB on darwin
+					buf.WriteString(fmt.Sprintf(`//go:cgo_import_dynamic _ _ "%s"`+"\n", names[name].paths[0]))
+				}
 				for _, f := range functions {
-					_, _ = create.WriteString(fmt.Sprintf(`//go:cgo_import_dynamic _%s %s "%s"`+"\n", f.name, f.linkname, lib))
+					var symbol = f.linkname
+					if f.version != "" && sys == "linux" {
+						symbol += "#" + f.version
+					}
+					buf.WriteString(fmt.Sprintf(`//go:cgo_import_dynamic _%s %s "%s"`+"\n", f.name, symbol, names[f.lib].paths[0]))
 				}
 			}
-			_ = create.Close()
+			if hasErrno { // the errno location function is called by the wrappers in both ways of resolving
+				buf.WriteString(fmt.Sprintf("\n//go:cgo_import_dynamic _ _ \"%s\"\n", errnoLocation[sys][1]))
+				buf.WriteString(fmt.Sprintf("//go:cgo_import_dynamic _%s_errno %s \"%s\"\n", fileNameNoExt, errnoLocation[sys][0], errnoLocation[sys][1]))
+			}
+			formatted, err := format.Source(buf.Bytes())
+			if err != nil {
+				panic(err)
+			}
+			err = os.WriteFile(pathNoExt+"_so_"+sys+"_"+arch+".go", formatted, 0666)
+			if err != nil {
+				panic(err)
+			}
 		}
 	}
 	if resolveWithDL { // Init function
@@ -174,12 +907,43 @@ func main() {
 		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
 		buf.WriteString(fmt.Sprintf("package %s\n", package_))
 
+		var hasOptional bool
+		for _, f := range functions {
+			hasOptional = hasOptional || f.optional
+		}
+
 		// import generation
-		buf.WriteString(`
-import (
-	"github.com/totallygamerjet/dl"
-)
-`)
+		buf.WriteString("import (\n")
+		if hasHashes {
+			buf.WriteString("\t\"crypto/sha256\"\n")
+			buf.WriteString("\t\"encoding/hex\"\n")
+		}
+		buf.WriteString("\t\"errors\"\n")
+		if hasOptional || hasHashes { // used by the resolve functions of optional ones and _verify
+			buf.WriteString("\t\"fmt\"\n")
+		}
+		if hasHashes {
+			buf.WriteString("\t\"io\"\n")
+		}
+		buf.WriteString("\t\"os\"\n")
+		buf.WriteString("\t\"path/filepath\"\n")
+		buf.WriteString("\t\"strings\"\n")
+		buf.WriteString("\t\"sync\"\n")
+		if lazy || unload {
+			buf.WriteString("\t\"sync/atomic\"\n")
+		}
+		if builtinDL || hasHashes {
+			buf.WriteString("\t\"runtime\"\n")
+		}
+		if builtinDL {
+			buf.WriteString("\t\"unsafe\"\n")
+		} else {
+			if hasVersions { // the top of the stack dlvsym is called on
+				buf.WriteString("\t\"unsafe\"\n")
+			}
+			buf.WriteString("\n\t\"github.com/totallygamerjet/dl\"\n")
+		}
+		buf.WriteString(")\n")
 
 		//variable generation
 		buf.WriteString("var (\n")
@@ -188,62 +952,1772 @@ import (
 		}
 		buf.WriteString(")\n")
 
-		// Init function generation
-		buf.WriteString("func Init() error {\n")
-		buf.WriteString(fmt.Sprintf("\tlib, err := dl.Open(_%s_SharedObject, dl.ScopeGlobal)\n", fileNameNoExt))
-		buf.WriteString("\tif err != nil {\n\t\treturn err\n\t}\n")
-		for _, f := range functions {
-			buf.WriteString(fmt.Sprintf("\t_%s, err = lib.Lookup(\"%s\")\n", f.name, f.linkname))
-			buf.WriteString("\tif err != nil {\n\t\treturn err\n\t}\n")
+		if builtinDL || hasVersions {
+			buf.WriteString(fmt.Sprintf(`
+// _%[1]s_dlStack is the stack that the functions of libdl are called on while
+// it's locked. The stack of a goroutine is too small for dlopen, which also runs
+// the initializers of the library.
+var _%[1]s_dlStack struct {
+	sync.Mutex
+	buf []byte
+}
+
+// _%[1]s_lockStack locks the stack of the functions of libdl and returns its top.
+func _%[1]s_lockStack() uintptr {
+	_%[1]s_dlStack.Lock()
+	if _%[1]s_dlStack.buf == nil {
+		_%[1]s_dlStack.buf = make([]byte, 1<<20) // the heap doesn't move
+	}
+	return uintptr(unsafe.Pointer(&_%[1]s_dlStack.buf[len(_%[1]s_dlStack.buf)-1])) &^ 15
+}
+`, fileNameNoExt))
 		}
-		buf.WriteString("\treturn nil\n")
-		buf.WriteString("}\n")
-		init, err := os.Create(fileNameNoExt + "_init.go")
-		if err != nil {
-			panic(err)
-			return
+
+		if builtinDL {
+			buf.WriteString(fmt.Sprintf(`
+// _%[1]s_lib is a library opened by dlopen.
+type _%[1]s_lib struct {
+	handle uintptr
+}
+
+// _%[1]s_dlOpen opens the library at path with dlopen.
+func _%[1]s_dlOpen(path string, mode int) (*_%[1]s_lib, error) {
+	// dlerror is per thread so it must be called on the same one
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stack := _%[1]s_lockStack()
+	defer _%[1]s_dlStack.Unlock()
+	handle := _%[1]s_libdl_dlopen(stack, &append([]byte(path), 0)[0], int32(mode))
+	if handle == 0 {
+		return nil, _%[1]s_dlerror(stack)
+	}
+	return &_%[1]s_lib{handle: handle}, nil
+}
+
+// Lookup returns the address of the symbol name in l.
+func (l *_%[1]s_lib) Lookup(name string) (uintptr, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stack := _%[1]s_lockStack()
+	defer _%[1]s_dlStack.Unlock()
+	_%[1]s_libdl_dlerror(stack) // a symbol can have the address zero so errors are checked with dlerror
+	addr := _%[1]s_libdl_dlsym(stack, l.handle, &append([]byte(name), 0)[0])
+	if err := _%[1]s_dlerror(stack); err != nil {
+		return 0, err
+	}
+	return addr, nil
+}
+
+// Close closes l with dlclose.
+func (l *_%[1]s_lib) Close() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stack := _%[1]s_lockStack()
+	defer _%[1]s_dlStack.Unlock()
+	if _%[1]s_libdl_dlclose(stack, l.handle) != 0 {
+		return _%[1]s_dlerror(stack)
+	}
+	return nil
+}
+
+// _%[1]s_dlerror returns the last error of dlopen, dlsym or dlclose on this thread
+// or nil if there hasn't been one. It's called on stack.
+func _%[1]s_dlerror(stack uintptr) error {
+	msg := _%[1]s_libdl_dlerror(stack)
+	if msg == nil {
+		return nil
+	}
+	var b []byte
+	for p := unsafe.Pointer(msg); *(*byte)(p) != 0; p = unsafe.Pointer(uintptr(p) + 1) {
+		b = append(b, *(*byte)(p))
+	}
+	return errors.New(string(b))
+}
+`, fileNameNoExt))
+			for _, f := range libdl {
+				buf.WriteString(fmt.Sprintf("\n// %s calls %s and is implemented in the assembly.\n%s\n\nvar _%s uintptr\n", f.name, f.linkname, f.sig, f.name))
+			}
 		}
-		formatted, err := format.Source(buf.Bytes())
-		if err != nil {
-			panic(err)
+
+		buf.WriteString(fmt.Sprintf(`
+// _%[1]s_expand replaces $ORIGIN or @executable_path at the start of path
+// with the directory of the executable after resolving any symlinks to it.
+func _%[1]s_expand(path string) (string, error) {
+	for _, origin := range [...]string{"$ORIGIN", "${ORIGIN}", "@executable_path"} {
+		if !strings.HasPrefix(path, origin) {
+			continue
 		}
-		_, _ = init.Write(formatted)
-		err = init.Close()
+		exe, err := os.Executable()
 		if err != nil {
-			return
+			return "", err
 		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			return "", err
+		}
+		return filepath.Join(filepath.Dir(exe), strings.TrimPrefix(path, origin)), nil
 	}
-	for sys, archs := range libs {
-		for arch := range archs {
-			if genFn, ok := generators[sys][arch]; ok {
-				buf.Reset()
-				buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n")
-				buf.WriteString("#include \"textflag.h\"\n\n")
-				for _, f := range functions {
-					gen := genFn(buf, f)
-					buf.WriteString(fmt.Sprintf("//%s\n", f.sig))
-					buf.WriteString(fmt.Sprintf("TEXT ·%s(SB), NOSPLIT, $0-0\n", f.name)) //TODO: calc proper stacksize
-					gen.PreCall()
-					for _, arg := range f.args {
-						gen.MovInst(arg)
-					}
-					gen.GenCall(f.name, resolveWithDL)
-					if f.ret.kind != VOID {
-						gen.RetInst(f.ret)
-					}
-					gen.PostCall()
-					buf.WriteString("\tRET\n\n")
-				}
-				create, err := os.Create(fileNameNoExt + "_" + sys + "_" + arch + ".s") // TODO: other archs
-				if err != nil {
-					panic(err)
-					return
-				}
-				_, _ = create.Write(buf.Bytes())
-			} else {
-				log.Println(fmt.Sprintf("the GOOS and GOARCH combo (%s, %s) is not supported.", sys, arch))
+	return path, nil
+}
+`, fileNameNoExt))
+
+		if hasHashes {
+			buf.WriteString(fmt.Sprintf(`
+// _%[1]s_search returns the absolute path of the first file named name in the
+// directories of the library path environment variable or the default library
+// path. A name that contains a slash is only made absolute.
+func _%[1]s_search(name string) (string, error) {
+	if strings.ContainsRune(name, '/') {
+		return filepath.Abs(name)
+	}
+	dirs := filepath.SplitList(os.Getenv(_%[1]s_LibraryPathEnv))
+	for _, dir := range append(dirs, _%[1]s_LibraryPath...) {
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return filepath.Abs(path)
+		}
+	}
+	return "", &os.PathError{Op: "search", Path: name, Err: os.ErrNotExist}
+}
+
+// _%[1]s_verified has the files that were verified on linux. They stay open so that
+// the descriptor that a library was opened from isn't reused by another one.
+var _%[1]s_verified struct {
+	sync.Mutex
+	files []*os.File
+}
+
+// _%[1]s_verify hashes the file that path refers to and returns the path to open
+// it from if the SHA-256 is one of sums. On linux the path refers to the descriptor
+// that was hashed so the dynamic loader can't open a different file.
+func _%[1]s_verify(path string, sums []string) (string, error) {
+	path, err := _%[1]s_search(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return "", err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	for _, want := range sums {
+		if !strings.EqualFold(got, want) {
+			continue
+		}
+		if runtime.GOOS != "linux" {
+			f.Close()
+			return path, nil
+		}
+		_%[1]s_verified.Lock()
+		_%[1]s_verified.files = append(_%[1]s_verified.files, f)
+		_%[1]s_verified.Unlock()
+		return fmt.Sprintf("/proc/self/fd/%%d", f.Fd()), nil
+	}
+	f.Close()
+	return "", fmt.Errorf("%%w: %%s has SHA-256 %%s", ErrChecksum, path, got)
+}
+`, fileNameNoExt))
+		}
+
+		for _, name := range libNames {
+			var openEmbedded string
+			if hasEmbeds {
+				// the embedded dependencies are opened before the library which is last
+				openEmbedded = fmt.Sprintf(`
+	if len(%[1]s_SharedObjectEmbed) > 0 {
+		embedded := %[1]s_SharedObjectEmbed
+		if override != nil { // only the dependencies are embedded ones
+			embedded = embedded[:len(embedded)-1]
+		}
+		var lib %[3]s
+		var path string
+		for _, name := range embedded {
+			data, err := %[1]s_SharedObjectFS.ReadFile(name)
+			if err != nil {
+				return nil, "", &LoadError{Library: name, Err: err}
+			}
+			file, done, err := _%[2]s_embedFile(filepath.Base(name), data)
+			if err != nil {
+				return nil, "", &LoadError{Library: name, Err: err}
+			}
+			lib, path, err = first([]string{file})
+			done() // the library is mapped once it's opened
+			if err != nil {
+				return nil, "", err
 			}
 		}
+		if override == nil {
+			return lib, path, nil
+		}
+	}`, libIdent(fileNameNoExt, name), fileNameNoExt, dlLib)
+			}
+			var declareSums, verify, sums, keepHandle string
+			if unload { // every handle that Init opens is kept so that Close can close it
+				keepHandle = fmt.Sprintf("\n\t\t\t\tif override == nil {\n\t\t\t\t\t%[1]s_handles = append(%[1]s_handles, lib)\n\t\t\t\t}", libIdent(fileNameNoExt, name))
+			}
+			if hasHashes {
+				verify = fmt.Sprintf(`
+			if len(sums) > 0 {
+				if path, err = _%[1]s_verify(path, sums); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}`, fileNameNoExt)
+				sums = fmt.Sprintf("\n\tsums = %s_SharedObjectSHA256", libIdent(fileNameNoExt, name))
+				declareSums = "\n\tvar sums []string // the library is verified but its dependencies aren't"
+			}
+			buf.WriteString(fmt.Sprintf(`
+// %[1]s_dlopen opens the dependencies of the library in order and then the first
+// of its paths that can be opened. It returns the library and the path it was opened from.
+// If the environment variable of the library is set its value is the only path that is tried.
+// If override isn't nil the library is opened from its paths instead.
+func %[1]s_dlopen(override []string) (%[9]s, string, error) {%[6]s
+	first := func(paths []string) (%[9]s, string, error) {
+		var errs []error
+		for _, path := range paths {
+			path, err := _%[2]s_expand(path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}%[4]s
+			lib, err := %[8]s(path, %[1]s_SharedObjectFlags)
+			if err == nil {%[7]s
+				return lib, path, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, "", &LoadError{Library: strings.Join(paths, ", "), Err: errors.Join(errs...)}
+	}
+	for _, paths := range %[1]s_SharedObjectPreload {
+		if _, _, err := first(paths); err != nil {
+			return nil, "", err
+		}
+	}%[5]s
+	if path := os.Getenv(%[1]s_SharedObjectEnv); override == nil && %[1]s_SharedObjectEnv != "" && path != "" {
+		return first([]string{path})
+	}%[3]s
+	if override != nil {
+		return first(override)
+	}
+	return first(%[1]s_SharedObjects)
+}
+`, libIdent(fileNameNoExt, name), fileNameNoExt, openEmbedded, verify, sums, declareSums, keepHandle, dlOpen, dlLib))
+		}
+
+		for _, name := range libNames {
+			if !lazy {
+				break
+			}
+			var ident = libIdent(fileNameNoExt, name)
+			var lookupSymbol = fmt.Sprintf("\taddr, err := %s_library.Lookup(linkname)", ident)
+			if hasVersions {
+				lookupSymbol = fmt.Sprintf(`	var addr uintptr
+	var err error
+	if version != "" {
+		addr, err = _%[2]s_lookupVersion(%[1]s_library, %[1]s_path, linkname, version)
+		linkname += "@" + version
+	} else {
+		addr, err = %[1]s_library.Lookup(linkname)
+	}`, ident, fileNameNoExt)
+			}
+			// the shared object is opened once by whichever function is called first
+			buf.WriteString(fmt.Sprintf(`
+var (
+	%[1]s_once    sync.Once
+	%[1]s_library %[4]s
+	%[1]s_path    string
+	%[1]s_err     error
+)
+
+// %[1]s_open opens the shared object the first time it is called.
+func %[1]s_open() error {
+	%[1]s_once.Do(func() {
+		%[1]s_library, %[1]s_path, %[1]s_err = %[1]s_dlopen(nil)
+	})
+	return %[1]s_err
+}
+
+// %[1]s_resolve looks up the symbol linkname of the Go function name
+// and stores its address in fn. The version is ignored if it's empty.
+func %[1]s_resolve(fn *uintptr, name, linkname, version string) error {
+	if err := %[1]s_open(); err != nil {
+		return err
+	}
+%[2]s
+	if err != nil {
+		return &LoadError{Library: %[1]s_path, Missing: []MissingSymbol{{name, linkname, err}}}
+	}
+	atomic.StoreUintptr(fn, addr)
+	return nil
+}
+`, ident, lookupSymbol, fileNameNoExt, dlLib))
+		}
+
+		if hasOptional {
+			for _, f := range functions {
+				if !f.optional {
+					continue
+				}
+				buf.WriteString(fmt.Sprintf("\n// Has%s reports whether %s was found in the shared object.\n", f.name, f.linkname))
+				if lazy {
+					buf.WriteString(fmt.Sprintf("func Has%s() bool { return atomic.LoadUintptr(&_%s) != 0 || %s_resolve(&_%s, \"%s\", \"%s\", \"%s\") == nil }\n", f.name, f.name, libIdent(fileNameNoExt, f.lib), f.name, f.name, f.linkname, f.version))
+				} else {
+					buf.WriteString(fmt.Sprintf("func Has%s() bool { return _%s != 0 }\n", f.name, f.name))
+				}
+			}
+		}
+
+		buf.WriteString("\n")
+
+		// each wrapper that can be called with a zero address calls its resolve function first
+		for _, f := range functions {
+			switch {
+			case f.optional && unload: // the call was counted as in flight by the wrapper
+				buf.WriteString(fmt.Sprintf("func _%[1]s_resolve() {\n\tif !Has%[2]s() {\n\t\tatomic.AddInt64(&_%[3]s_inflight, -1)\n\t\t_%[3]s_drained()\n\t\tpanic(fmt.Errorf(\"%[4]s: %%w\", ErrUnavailable))\n\t}\n}\n\n", f.name, f.name, fileNameNoExt, f.linkname))
+			case f.optional:
+				buf.WriteString(fmt.Sprintf("func _%s_resolve() {\n\tif !Has%s() {\n\t\tpanic(fmt.Errorf(\"%s: %%w\", ErrUnavailable))\n\t}\n}\n\n", f.name, f.name, f.linkname))
+			case lazy:
+				buf.WriteString(fmt.Sprintf("func _%s_resolve() {\n\tif err := %s_resolve(&_%s, \"%s\", \"%s\", \"%s\"); err != nil {\n\t\tpanic(err)\n\t}\n}\n\n", f.name, libIdent(fileNameNoExt, f.lib), f.name, f.name, f.linkname, f.version))
+			}
+		}
+
+		// each library is opened by its own init function.
+		// Every symbol is looked up even if some fail so the error lists all the missing ones.
+		for _, name := range libNames {
+			var ident = libIdent(fileNameNoExt, name)
+			var fns []Function
+			for _, f := range functions {
+				if f.lib == name {
+					fns = append(fns, f)
+				}
+			}
+			buf.WriteString(fmt.Sprintf("func %s_init() error {\n", ident))
+			if lazy {
+				buf.WriteString(fmt.Sprintf("\tif err := %s_open(); err != nil {\n\t\treturn err\n\t}\n", ident))
+				if len(fns) == 0 {
+					buf.WriteString("\treturn nil\n}\n\n")
+					continue
+				}
+				buf.WriteString(fmt.Sprintf("\tlib, path := %s_library, %s_path\n", ident, ident))
+				buf.WriteString("\tvar err error\n")
+			} else {
+				if len(fns) == 0 {
+					buf.WriteString(fmt.Sprintf("\t_, _, err := %s_dlopen(nil)\n", ident))
+					buf.WriteString("\treturn err\n}\n\n")
+					continue
+				}
+				buf.WriteString(fmt.Sprintf("\tlib, path, err := %s_dlopen(nil)\n", ident))
+				buf.WriteString("\tif err != nil {\n\t\treturn err\n\t}\n")
+			}
+			buf.WriteString("\tvar missing []MissingSymbol\n")
+			for _, f := range fns {
+				if f.optional { // a missing optional symbol is left as zero
+					buf.WriteString(fmt.Sprintf("\t_%s, _ = %s\n", f.name, f.lookup(fileNameNoExt)))
+					continue
+				}
+				buf.WriteString(fmt.Sprintf("\tif _%s, err = %s; err != nil {\n", f.name, f.lookup(fileNameNoExt)))
+				buf.WriteString(fmt.Sprintf("\t\tmissing = append(missing, MissingSymbol{\"%s\", \"%s\", err})\n\t}\n", f.name, f.symbol()))
+			}
+			buf.WriteString("\tif missing != nil {\n")
+			buf.WriteString("\t\treturn &LoadError{Library: path, Missing: missing}\n\t}\n")
+			buf.WriteString("\treturn nil\n")
+			buf.WriteString("}\n\n")
+		}
+
+		if unload {
+			buf.WriteString(fmt.Sprintf(`
+var (
+	_%[1]s_inflight int64  // the number of calls that are executing
+	_%[1]s_loaded   uint32 // 1 after Init succeeds and until Close is called
+	_%[1]s_drain    = sync.NewCond(&sync.Mutex{})
+)
+
+// _%[1]s_drained wakes Close if it's waiting for the calls in flight. It's called
+// when the last call stops being counted while the libraries aren't loaded.
+func _%[1]s_drained() {
+	_%[1]s_drain.L.Lock()
+	_%[1]s_drain.Broadcast()
+	_%[1]s_drain.L.Unlock()
+}
+
+// _%[1]s_closed is called by a wrapper when the libraries aren't loaded
+// after it stopped counting the call.
+func _%[1]s_closed() {
+	_%[1]s_drained()
+	panic(ErrClosed)
+}
+
+// _%[1]s_Close stops any new calls, waits for the calls in flight to return and then
+// closes the libraries opened by _%[1]s_Init.
+func _%[1]s_Close() error {
+	_%[1]s_initMu.Lock()
+	defer _%[1]s_initMu.Unlock()
+	_%[1]s_initDone, _%[1]s_initErr = false, nil
+	atomic.StoreUint32(&_%[1]s_loaded, 0)
+	_%[1]s_drain.L.Lock()
+	for atomic.LoadInt64(&_%[1]s_inflight) != 0 {
+		_%[1]s_drain.Wait()
+	}
+	_%[1]s_drain.L.Unlock()
+`, fileNameNoExt))
+			for _, f := range functions {
+				buf.WriteString(fmt.Sprintf("\tatomic.StoreUintptr(&_%s, 0)\n", f.name))
+			}
+			buf.WriteString("\tvar errs []error\n")
+			for i := len(libNames) - 1; i >= 0; i-- {
+				// the libraries are closed in the opposite order to how they were opened
+				var ident = libIdent(fileNameNoExt, libNames[i])
+				buf.WriteString(fmt.Sprintf(`	for i := len(%[1]s_handles) - 1; i >= 0; i-- {
+		if err := %[1]s_handles[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	%[1]s_handles = nil
+`, ident))
+			}
+			buf.WriteString("\treturn errors.Join(errs...)\n}\n\n")
+			buf.WriteString("var (\n")
+			for _, name := range libNames {
+				buf.WriteString(fmt.Sprintf("\t%s_handles []%s\n", libIdent(fileNameNoExt, name), dlLib))
+			}
+			buf.WriteString(")\n\n")
+		}
+
+		// Init function generation
+		buf.WriteString(fmt.Sprintf(`var (
+	_%[1]s_initMu   sync.Mutex
+	_%[1]s_initDone bool  // Init has been called
+	_%[1]s_initErr  error // the error returned by the first call to Init
+)
+
+// _%[1]s_Init opens the libraries and resolves every function of the stub file.
+// Only the first call does anything and every call returns its error.
+func _%[1]s_Init() error {
+	_%[1]s_initMu.Lock()
+	defer _%[1]s_initMu.Unlock()
+	if !_%[1]s_initDone {
+		_%[1]s_initErr, _%[1]s_initDone = _%[1]s_load(), true
+	}
+	return _%[1]s_initErr
+}
+`, fileNameNoExt))
+		switch autoinit {
+		case "panic":
+			buf.WriteString(fmt.Sprintf("\nfunc init() {\n\tif err := _%s_Init(); err != nil {\n\t\tpanic(err)\n\t}\n}\n", fileNameNoExt))
+		case "record": // the error is returned by every later call to Init
+			buf.WriteString(fmt.Sprintf("\nfunc init() {\n\t_ = _%s_Init()\n}\n", fileNameNoExt))
+		}
+		buf.WriteString(fmt.Sprintf("\nfunc _%s_load() error {\n", fileNameNoExt))
+		var ret = "return"
+		if unload {
+			ret = "err :="
+		}
+		if len(libNames) == 1 {
+			buf.WriteString(fmt.Sprintf("\t%s %s_init()\n", ret, libIdent(fileNameNoExt, libNames[0])))
+		} else {
+			// every library is opened even if one fails
+			buf.WriteString("\tvar errs []error\n")
+			for _, name := range libNames {
+				buf.WriteString(fmt.Sprintf("\tif err := %s_init(); err != nil {\n\t\terrs = append(errs, err)\n\t}\n", libIdent(fileNameNoExt, name)))
+			}
+			buf.WriteString(fmt.Sprintf("\t%s errors.Join(errs...)\n", ret))
+		}
+		if unload { // the functions can only be called once every symbol is resolved
+			buf.WriteString(fmt.Sprintf("\tif err == nil {\n\t\tatomic.StoreUint32(&_%s_loaded, 1)\n\t}\n\treturn err\n", fileNameNoExt))
+		}
+		buf.WriteString("}\n")
+		init, err := os.Create(pathNoExt + "_init.go")
+		if err != nil {
+			panic(err)
+			return
+		}
+		formatted, err := format.Source(buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		_, _ = init.Write(formatted)
+		err = init.Close()
+		if err != nil {
+			return
+		}
+	}
+	if library { // Library type
+		var ident = libIdent(fileNameNoExt, libNames[0])
+		var hasOptional bool
+		var imports []string
+		if !builtinDL {
+			imports = append(imports, "github.com/totallygamerjet/dl")
+		}
+		for _, f := range functions {
+			hasOptional = hasOptional || f.optional
+		}
+		if hasOptional {
+			imports = append(imports, "fmt")
+		}
+		// the packages used by the signatures of the stubs are needed by the methods
+		imports = append(imports, sigImports(file, functions)...)
+		buf.Reset()
+		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+		buf.WriteString(fmt.Sprintf("package %s\n\n", package_))
+		writeImports(buf, imports...)
+		buf.WriteString(fmt.Sprintf(`// Library is a shared object that was opened by Open. Its methods call the
+// functions of that shared object instead of the one opened by Init so that
+// more than one version of it can be used at the same time.
+type Library struct {
+	lib  %s
+	path string // the path it was opened from
+`, dlLib))
+		for _, f := range functions {
+			buf.WriteString(fmt.Sprintf("\t_%s uintptr\n", f.name))
+		}
+		buf.WriteString("}\n")
+		buf.WriteString(fmt.Sprintf(`
+// Open opens the shared object at path like Init opens the library, so its
+// dependencies are opened first and it is verified if it has a SHA-256, and
+// resolves every function from it. If it couldn't be opened or some of the
+// functions couldn't be found it returns a *LoadError.
+func Open(path string) (*Library, error) {
+	lib, path, err := %[1]s_dlopen([]string{path})
+	if err != nil {
+		return nil, err
+	}
+	l := &Library{lib: lib, path: path}
+	var missing []MissingSymbol
+`, ident))
+		for _, f := range functions {
+			if f.optional { // a missing optional symbol is left as zero
+				buf.WriteString(fmt.Sprintf("\tl._%s, _ = %s\n", f.name, f.lookup(fileNameNoExt)))
+				continue
+			}
+			buf.WriteString(fmt.Sprintf("\tif l._%s, err = %s; err != nil {\n", f.name, f.lookup(fileNameNoExt)))
+			buf.WriteString(fmt.Sprintf("\t\tmissing = append(missing, MissingSymbol{\"%s\", \"%s\", err})\n\t}\n", f.name, f.symbol()))
+		}
+		buf.WriteString(`	if missing != nil {
+		_ = lib.Close()
+		return nil, &LoadError{Library: path, Missing: missing}
+	}
+	return l, nil
+}
+
+// Path returns the path that l was opened from.
+func (l *Library) Path() string { return l.path }
+
+// Close closes the shared object. The methods of l must not be called once
+// Close has been called or while it is executing.
+func (l *Library) Close() error { return l.lib.Close() }
+`)
+		for _, f := range functions {
+			var params []string
+			for _, a := range f.args {
+				params = append(params, a.name)
+			}
+			var call = f.call()
+			var method = "func (l *Library) " + strings.TrimPrefix(f.sig, "func ")
+			var result = "return "
+			if f.ret.kind == VOID && f.errno == nil {
+				result = ""
+			}
+			if f.optional {
+				buf.WriteString(fmt.Sprintf(`
+// Has%[1]s reports whether %[2]s was found in l.
+func (l *Library) Has%[1]s() bool { return l._%[1]s != 0 }
+`, f.name, f.symbol()))
+				buf.WriteString(fmt.Sprintf("\n%s {\n", method))
+				buf.WriteString(fmt.Sprintf("\tif l._%s == 0 {\n\t\tpanic(fmt.Errorf(\"%s: %%w\", ErrUnavailable))\n\t}\n", f.name, f.symbol()))
+			} else {
+				buf.WriteString(fmt.Sprintf("\n%s {\n", method))
+			}
+			var args = strings.Join(append([]string{"l._" + f.name}, params...), ", ")
+			switch {
+			case f.queue != "" && f.ret.kind == VOID:
+				buf.WriteString(fmt.Sprintf("\t%s.do(func(stack uintptr) { %s(stack, %s) })\n}\n", f.queue, call.name, args))
+			case f.queue != "":
+				buf.WriteString(fmt.Sprintf("\tvar _r %s\n\t%s.do(func(stack uintptr) { _r = %s(stack, %s) })\n\treturn _r\n}\n", f.result, f.queue, call.name, args))
+			default:
+				buf.WriteString(fmt.Sprintf("\t%s%s(%s)\n}\n", result, call.name, args))
+			}
+			buf.WriteString(fmt.Sprintf("\n%s\n", call.sig))
+		}
+		formatted, err := format.Source(buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		if err = os.WriteFile(pathNoExt+"_library.go", formatted, 0666); err != nil {
+			panic(err)
+		}
+	}
+	var shared = make(map[string]Function) // the name of each function that shares a wrapper -> the wrapper
+	var wrappers []Function                // the shared wrappers in the order they are first used
+	if shapes {
+		var byKey = make(map[string]Function)
+		for _, f := range functions {
+			if f.queue != "" || f.errno != nil || (resolveWithDL && f.optional) { // the wrapper of f does more than call it
+				continue
+			}
+			var w = f.shape(fmt.Sprintf("_%s_shape%d", fileNameNoExt, len(wrappers)))
+			var key = strings.TrimPrefix(w.sig, "func "+w.name)
+			if f.fast {
+				key = "fast " + key
+			}
+			if existing, ok := byKey[key]; ok {
+				w = existing
+			} else {
+				byKey[key] = w
+				wrappers = append(wrappers, w)
+			}
+			shared[f.name] = w
+		}
+		log.Printf("%s: %d functions share %d wrappers\n", fileName, len(shared), len(wrappers))
+		buf.Reset()
+		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+		buf.WriteString(fmt.Sprintf("package %s\n\n", package_))
+		for _, w := range wrappers {
+			if strings.Contains(w.sig, "unsafe.Pointer") {
+				writeImports(buf, "unsafe")
+				break
+			}
+		}
+		for _, w := range wrappers {
+			buf.WriteString(fmt.Sprintf("\n// %s calls the C function whose address is in the context register.\n", w.name))
+			buf.WriteString(fmt.Sprintf("// It is implemented in the assembly.\n%s\n", w.sig))
+		}
+		formatted, err := format.Source(buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		if err = os.WriteFile(pathNoExt+"_shapes.go", formatted, 0666); err != nil {
+			panic(err)
+		}
+	}
+	if hasQueues {
+		buf.Reset()
+		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+		buf.WriteString(fmt.Sprintf("package %s\n\n", package_))
+		var queued []Function
+		for _, f := range functions {
+			if f.queue != "" {
+				queued = append(queued, f)
+			}
+		}
+		writeImports(buf, sigImports(file, queued)...)
+		if hasWorkers {
+			buf.WriteString(fmt.Sprintf("// _%[1]s_workers are the threads that make the calls of //onlygo:worker functions\n", fileNameNoExt))
+			buf.WriteString(fmt.Sprintf("var _%s_workers = &_onlygo_queue{threads: %d, jobs: make(chan func(stack uintptr))}\n", fileNameNoExt, workers))
+		}
+		for _, f := range functions {
+			if f.queue == "" {
+				continue
+			}
+			var params []string
+			for _, a := range f.args {
+				params = append(params, a.name)
+			}
+			var args = strings.Join(params, ", ")
+			var direct = f.direct()
+			var directArgs = strings.Join(append([]string{"stack"}, params...), ", ")
+			var rest = strings.TrimPrefix(f.sig, "func "+f.name)
+			var paramList = rest[:strings.IndexRune(rest, ')')+1]
+			buf.WriteString(fmt.Sprintf("\n// _%[1]s_dispatch is jumped to by %[1]s to call %[2]s on a thread of %[3]s.\n", f.name, f.symbol(), f.queue))
+			if f.ret.kind == VOID {
+				buf.WriteString(fmt.Sprintf("func _%s_dispatch%s {\n\t%s.do(func(stack uintptr) { %s(%s) })\n}\n", f.name, paramList, f.queue, direct.name, directArgs))
+			} else {
+				buf.WriteString(fmt.Sprintf("func _%s_dispatch%s (_r %s) {\n\t%s.do(func(stack uintptr) { _r = %s(%s) })\n\treturn _r\n}\n", f.name, paramList, f.result, f.queue, direct.name, directArgs))
+			}
+			buf.WriteString(fmt.Sprintf("\n%s\n", direct.sig))
+			if !f.async {
+				continue
+			}
+			buf.WriteString(fmt.Sprintf("\n// %[1]sAsync calls %[1]s in a new goroutine and returns a channel that receives\n// its result once it returns. A panic of %[1]s can't be recovered from.\n", f.name))
+			if f.ret.kind == VOID {
+				buf.WriteString(fmt.Sprintf("func %[1]sAsync%[2]s <-chan struct{} {\n\tvar c = make(chan struct{}, 1)\n\tgo func() {\n\t\t%[1]s(%[3]s)\n\t\tc <- struct{}{}\n\t}()\n\treturn c\n}\n", f.name, paramList, args))
+			} else {
+				buf.WriteString(fmt.Sprintf("func %[1]sAsync%[2]s <-chan %[4]s {\n\tvar c = make(chan %[4]s, 1)\n\tgo func() { c <- %[1]s(%[3]s) }()\n\treturn c\n}\n", f.name, paramList, args, f.result))
+			}
+		}
+		formatted, err := format.Source(buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		if err = os.WriteFile(pathNoExt+"_threads.go", formatted, 0666); err != nil {
+			panic(err)
+		}
+	}
+	if batch {
+		buf.Reset()
+		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+		buf.WriteString(fmt.Sprintf("package %s\n\n", package_))
+		var batched []Function
+		for _, f := range functions {
+			if f.batchable() {
+				batched = append(batched, f)
+			}
+		}
+		writeImports(buf, append(sigImports(file, batched), "unsafe")...)
+		for _, f := range batched {
+			if !resolveWithDL { // the assembly stores the address of the trampoline of the imported symbol
+				buf.WriteString(fmt.Sprintf("\n// _%s is the address of the function that jumps to %s\nvar _%[1]s uintptr\n", f.name, f.symbol()))
+			}
+			var rest = strings.TrimPrefix(f.sig, "func "+f.name)
+			var paramList = rest[:strings.IndexRune(rest, ')')+1]
+			var ints, floats []string
+			var keep []string
+			for _, a := range f.args {
+				if a.kind == F32 || a.kind == F64 {
+					floats = append(floats, a.register())
+				} else {
+					ints = append(ints, a.register())
+				}
+				if a.kind == PTR && a.typ != "uintptr" {
+					keep = append(keep, "unsafe.Pointer("+a.name+")")
+				}
+			}
+			var call = fmt.Sprintf("fn: _%s", f.name)
+			if len(ints) > 0 {
+				call += fmt.Sprintf(", ints: [8]uintptr{%s}", strings.Join(ints, ", "))
+			}
+			if len(floats) > 0 {
+				call += fmt.Sprintf(", floats: [8]uint64{%s}", strings.Join(floats, ", "))
+			}
+			if f.ret.kind == VOID {
+				buf.WriteString(fmt.Sprintf("\n// %s records a call to %s.\nfunc (_b *Batch) %[1]s%[3]s {\n", f.name, f.symbol(), paramList))
+			} else {
+				buf.WriteString(fmt.Sprintf("\n// %s records a call to %s. The value it returns is set to the result once Run returns.\n", f.name, f.symbol()))
+				buf.WriteString(fmt.Sprintf("func (_b *Batch) %s%s *%s {\n\tvar _r = new(%[3]s)\n", f.name, paramList, f.result))
+				call += fmt.Sprintf(", out: unsafe.Pointer(_r), size: %d", sizeof(f.ret))
+				if f.ret.kind == PTR && f.result != "uintptr" {
+					call += ", ptr: true"
+				}
+			}
+			if resolveWithDL && (lazy || f.optional) {
+				buf.WriteString(fmt.Sprintf("\tif _%s == 0 {\n\t\t_%[1]s_resolve()\n\t}\n", f.name))
+			}
+			if len(keep) > 0 {
+				buf.WriteString(fmt.Sprintf("\t_b.keep = append(_b.keep, %s)\n", strings.Join(keep, ", ")))
+			}
+			buf.WriteString(fmt.Sprintf("\t_b.calls = append(_b.calls, _onlygo_call{%s})\n", call))
+			if f.ret.kind != VOID {
+				buf.WriteString("\treturn _r\n")
+			}
+			buf.WriteString("}\n")
+		}
+		formatted, err := format.Source(buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		if err = os.WriteFile(pathNoExt+"_batch.go", formatted, 0666); err != nil {
+			panic(err)
+		}
+	}
+	if hasErrors {
+		buf.Reset()
+		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+		buf.WriteString(fmt.Sprintf("package %s\n\n", package_))
+		var byName = make(map[string]Function)
+		var checked []Function // the variants that return an error
+		for _, f := range functions {
+			byName[f.name] = f
+			if f.check != "" {
+				var rest = strings.TrimPrefix(f.sig, "func "+f.name)
+				var v = f
+				v.sig = fmt.Sprintf("func %sErr%s (%s, error)", f.name, rest[:strings.IndexRune(rest, ')')+1], f.result)
+				checked = append(checked, v)
+			}
+		}
+		writeImports(buf, sigImports(file, checked)...)
+		for _, f := range checked {
+			var d = byName[f.describe]
+			buf.WriteString(fmt.Sprintf("\n// %sErr calls %[1]s and returns a *CallError if %s %s.\n", f.name, f.symbol(), failure[f.check]))
+			buf.WriteString(fmt.Sprintf("%s {\n%s}\n", f.sig, f.errorBody("", d)))
+			if library {
+				buf.WriteString(fmt.Sprintf("\n// %sErr calls %[1]s of l and returns a *CallError if %s %s.\n", f.name, f.symbol(), failure[f.check]))
+				buf.WriteString(fmt.Sprintf("func (l *Library) %s {\n%s}\n", strings.TrimPrefix(f.sig, "func "), f.errorBody("l.", d)))
+			}
+		}
+		formatted, err := format.Source(buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		if err = os.WriteFile(pathNoExt+"_errors.go", formatted, 0666); err != nil {
+			panic(err)
+		}
+	}
+	for sys, archs := range libs {
+		for arch := range archs {
+			if genFn, ok := generators[sys][arch]; ok {
+				buf.Reset()
+				buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n")
+				buf.WriteString("#include \"textflag.h\"\n")
+				buf.WriteString("#include \"funcdata.h\"\n\n")
+				var track string
+				if unload {
+					track = "_" + fileNameNoExt
+				}
+				for _, f := range functions {
+					if w, ok := shared[f.name]; ok {
+						writeJump(buf, genFn, f, w, resolveWithDL)
+						continue
+					}
+					writeFunc(buf, genFn, f, resolveWithDL && (lazy || f.optional), resolveWithDL, track)
+				}
+				for _, w := range wrappers {
+					writeFunc(buf, genFn, w, false, resolveWithDL, track)
+				}
+				if resolveWithDL && hasVersions && sys == "linux" {
+					writeFunc(buf, genFn, dlvsym, false, true, "")
+					if !builtinDL { // they're in libdl otherwise
+						writeFunc(buf, genFn, libdl[0], false, true, "")
+						writeFunc(buf, genFn, libdl[3], false, true, "")
+					}
+				}
+				if builtinDL {
+					var imported = libdl
+					if hasVersions && sys == "linux" {
+						imported = append(imported, dlvsym)
+					}
+					for _, f := range libdl {
+						writeFunc(buf, genFn, f, false, true, "")
+					}
+					for _, f := range imported {
+						writeTrampoline(buf, f)
+					}
+				}
+				if library {
+					for _, f := range functions {
+						writeFunc(buf, genFn, f.call(), false, true, "")
+					}
+				}
+				if batch && !resolveWithDL {
+					for _, f := range functions {
+						if f.batchable() {
+							buf.WriteString(fmt.Sprintf("GLOBL ·_%s(SB), RODATA, $8\n", f.name))
+							buf.WriteString(fmt.Sprintf("DATA ·_%s(SB)/8, $%[1]s_jmp<>(SB)\n\n", f.name))
+						}
+					}
+				}
+				if hasErrno {
+					buf.WriteString("TEXT _errno_jmp<>(SB), NOSPLIT|NOFRAME, $0-0\n")
+					buf.WriteString(fmt.Sprintf("\tJMP _%s_errno(SB)\n\n", fileNameNoExt))
+				}
+				genFn(buf, Function{}).StackHelper()
+				for _, f := range functions {
+					if f.fast {
+						genFn(buf, Function{}).SystemHelper()
+						break
+					}
+				}
+				create, err := os.Create(pathNoExt + "_" + sys + "_" + arch + ".s") // TODO: other archs
+				if err != nil {
+					panic(err)
+					return
+				}
+				_, _ = create.Write(buf.Bytes())
+			} else {
+				log.Println(fmt.Sprintf("the GOOS and GOARCH combo (%s, %s) is not supported.", sys, arch))
+			}
+		}
+	}
+	return stub
+}
+
+// writePackage writes the functions and types that are shared by every stub
+// file of a package. Init and Close call the ones of each stub file.
+func writePackage(stubs []Stub) {
+	var inits, closes []string
+	var optional, checksum, unload, library, bootstrap, queues, mainthread, batch, callErrors bool
+	var groups []string
+	var platforms [][2]string
+	for _, s := range stubs {
+		if s.pkg != stubs[0].pkg {
+			log.Fatalf("%s and %s are in the same directory but different packages", s.fileNameNoExt, stubs[0].fileNameNoExt)
+		}
+		if s.library && library {
+			log.Fatal("only one stub file in a package can use //onlygo:library")
+		}
+		if s.init {
+			inits = append(inits, "_"+s.fileNameNoExt+"_Init()")
+		}
+		if s.unload {
+			closes = append(closes, "_"+s.fileNameNoExt+"_Close()")
+		}
+		optional = optional || s.optional
+		checksum = checksum || s.checksum
+		unload = unload || s.unload
+		library = library || s.library
+		bootstrap = bootstrap || s.bootstrap
+		queues = queues || s.queues
+		mainthread = mainthread || s.mainthread
+		batch = batch || s.batch
+		callErrors = callErrors || s.errors
+		for _, p := range s.platforms {
+			var declared bool
+			for _, d := range platforms {
+				declared = declared || d == p
+			}
+			if !declared {
+				platforms = append(platforms, p)
+			}
+		}
+		for _, g := range s.groups {
+			var declared bool
+			for _, d := range groups {
+				declared = declared || d == g
+			}
+			if !declared {
+				groups = append(groups, g)
+			}
+		}
+	}
+	if bootstrap {
+		writeBootstrap(stubs[0].dir, stubs[0].pkg)
+	}
+	if queues {
+		writeQueues(stubs[0].dir, stubs[0].pkg, mainthread, groups)
+	}
+	if batch {
+		writeBatch(stubs[0].dir, stubs[0].pkg, platforms)
+	}
+	if callErrors {
+		writeErrors(stubs[0].dir, stubs[0].pkg)
+	}
+	if len(inits) == 0 { // every stub file is resolved by cgo
+		return
+	}
+	var buf = &bytes.Buffer{}
+	buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+	buf.WriteString(fmt.Sprintf("package %s\n\n", stubs[0].pkg))
+	var imports = []string{"fmt", "strings"}
+	if optional || checksum || unload || len(inits) > 1 {
+		imports = append(imports, "errors")
+	}
+	writeImports(buf, imports...)
+	buf.WriteString(`// LoadError is returned by Init when the shared object couldn't be opened
+// or some of its symbols couldn't be resolved.
+type LoadError struct {
+	Library string          // the path passed to dlopen
+	Err     error           // the reason dlopen failed or nil if it succeeded
+	Missing []MissingSymbol // every symbol that couldn't be resolved
+}
+
+// MissingSymbol is a function whose symbol couldn't be resolved.
+type MissingSymbol struct {
+	Name     string // the name of the Go function
+	Linkname string // the name of the C symbol
+	Err      error  // the reason the lookup failed
+}
+
+func (e *LoadError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("onlygo: failed to open %s: %v", e.Library, e.Err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "onlygo: %d unresolved symbol(s) in %s:", len(e.Missing), e.Library)
+	for _, m := range e.Missing {
+		fmt.Fprintf(&b, "\n\t%s (%s): %v", m.Linkname, m.Name, m.Err)
+	}
+	return b.String()
+}
+
+func (e *LoadError) Unwrap() error { return e.Err }
+`)
+	if optional {
+		buf.WriteString(`
+// ErrUnavailable is the error a function marked with //onlygo:optional
+// panics with when it is called but its symbol couldn't be found.
+var ErrUnavailable = errors.New("onlygo: symbol is not available")
+`)
+	}
+	if checksum {
+		buf.WriteString(`
+// ErrChecksum is wrapped by the error returned by Init when the file of a
+// library doesn't have any of the SHA-256 sums it was declared with.
+var ErrChecksum = errors.New("onlygo: checksum mismatch")
+`)
+	}
+	if unload {
+		buf.WriteString(`
+// ErrClosed is the error the functions panic with when they are called
+// after Close and before Init succeeds again.
+var ErrClosed = errors.New("onlygo: library is closed")
+
+// Close stops any new calls, waits for the calls in flight to return and then
+// closes the libraries opened by Init of every stub file that uses //onlygo:unload.
+// Init can be called again afterwards to open them again, for example after
+// they have been rebuilt.
+`)
+		if len(closes) == 1 {
+			buf.WriteString(fmt.Sprintf("func Close() error {\n\treturn %s\n}\n", closes[0]))
+		} else {
+			buf.WriteString(fmt.Sprintf("func Close() error {\n\treturn errors.Join(%s)\n}\n", strings.Join(closes, ", ")))
+		}
+	}
+	buf.WriteString(`
+// Init opens the libraries and resolves the functions of every stub file. It MUST be
+// called before any of the functions are. Only the first call does anything and every
+// call returns its error so it is safe to call from more than one goroutine.
+`)
+	if len(inits) == 1 {
+		buf.WriteString(fmt.Sprintf("func Init() error {\n\treturn %s\n}\n", inits[0]))
+	} else { // every stub file is initialized even if one fails
+		buf.WriteString(fmt.Sprintf("func Init() error {\n\treturn errors.Join(%s)\n}\n", strings.Join(inits, ", ")))
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(filepath.Join(stubs[0].dir, "onlygo_init.go"), formatted, 0666); err != nil {
+		panic(err)
+	}
+}
+
+// writeQueues writes the type of the queues of threads that make the calls of the functions
+// marked with //onlygo:worker, //onlygo:mainthread or //onlygo:threadaffine, the queue of each
+// group of //onlygo:threadaffine and, if mainthread is true, the queue of the main thread and Main.
+func writeQueues(dir, pkg string, mainthread bool, groups []string) {
+	var buf = &bytes.Buffer{}
+	buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+	buf.WriteString(fmt.Sprintf("package %s\n\n", pkg))
+	writeImports(buf, "runtime", "sync", "unsafe")
+	buf.WriteString(`// _onlygo_stackSize is the size of the stack each thread of a queue calls C on.
+// The stack of its goroutine is too small for most C functions and can move.
+const _onlygo_stackSize = 1 << 20
+
+// _onlygo_queue is a set of threads that only make the calls given to it. Each
+// one is locked to its own goroutine for the rest of the program.
+type _onlygo_queue struct {
+	threads int // how many threads are started by the first call
+	jobs    chan func(stack uintptr)
+	once    sync.Once
+}
+
+// serve makes the calls given to q on the current thread until done is closed.
+func (q *_onlygo_queue) serve(done <-chan struct{}) {
+	var stack = make([]byte, _onlygo_stackSize) // the heap doesn't move
+	var top = (uintptr(unsafe.Pointer(&stack[0])) + _onlygo_stackSize) &^ 15
+	for {
+		select {
+		case job := <-q.jobs:
+			job(top)
+		case <-done:
+			runtime.KeepAlive(stack)
+			return
+		}
+	}
+}
+
+// do calls fn on one of the threads of q with the top of its C stack and waits
+// for it to return. A panic of fn happens again in the caller.
+func (q *_onlygo_queue) do(fn func(stack uintptr)) {
+	q.once.Do(func() {
+		for i := 0; i < q.threads; i++ {
+			go func() {
+				runtime.LockOSThread() // never unlocked so the thread only makes the calls
+				q.serve(nil)
+			}()
+		}
+	})
+	var done = make(chan struct{})
+	var p interface{}
+	q.jobs <- func(stack uintptr) {
+		defer close(done)
+		defer func() { p = recover() }()
+		fn(stack)
+	}
+	<-done
+	if p != nil {
+		panic(p)
+	}
+}
+`)
+	for _, g := range groups {
+		buf.WriteString(fmt.Sprintf("\n// _onlygo_affine_%[1]s is the thread that makes every call of //onlygo:threadaffine %[1]s\n", g))
+		buf.WriteString(fmt.Sprintf("var _onlygo_affine_%s = &_onlygo_queue{threads: 1, jobs: make(chan func(stack uintptr))}\n", g))
+	}
+	if mainthread {
+		buf.WriteString(`
+// _onlygo_mainthread makes the calls of //onlygo:mainthread once Main serves it
+var _onlygo_mainthread = &_onlygo_queue{jobs: make(chan func(stack uintptr))}
+
+func init() {
+	runtime.LockOSThread() // the main goroutine stays on the main thread for Main
+}
+
+// Main hands the main thread over to the functions marked with //onlygo:mainthread.
+// It calls fn in a new goroutine and makes their calls on the main thread until fn
+// returns. It MUST be called from main.main which runs on the main thread because
+// the package locks it there when it is initialized. Calls made before Main wait for it.
+func Main(fn func()) {
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	_onlygo_mainthread.serve(done)
+}
+`)
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "onlygo_threads.go"), formatted, 0666); err != nil {
+		panic(err)
+	}
+}
+
+// writeErrors writes the CallError type that the variants of the functions
+// marked with //onlygo:error return.
+func writeErrors(dir, pkg string) {
+	var buf = &bytes.Buffer{}
+	buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+	buf.WriteString(fmt.Sprintf("package %s\n\n", pkg))
+	writeImports(buf, "fmt", "syscall", "unsafe")
+	buf.WriteString(`// CallError is returned by the variants of the functions marked with //onlygo:error,
+// which end in Err, when the C function reports that it failed.
+type CallError struct {
+	Func    string        // the name of the C function
+	Code    int64         // the value it returned; zero if it returned NULL
+	Errno   syscall.Errno // the value of errno if the function is marked with //onlygo:errno
+	Message string        // the description of the error by the function named in the directive
+}
+
+func (e *CallError) Error() string {
+	switch {
+	case e.Message != "":
+		return e.Func + ": " + e.Message
+	case e.Errno != 0:
+		return e.Func + ": " + e.Errno.Error()
+	case e.Code != 0:
+		return fmt.Sprintf("%s: failed with %d", e.Func, e.Code)
+	default:
+		return e.Func + ": returned NULL"
+	}
+}
+
+// Unwrap returns Errno if it isn't zero so that errors.Is can compare it
+// with errors like fs.ErrNotExist.
+func (e *CallError) Unwrap() error {
+	if e.Errno == 0 {
+		return nil
+	}
+	return e.Errno
+}
+
+// _onlygo_gostring copies the NUL terminated string at p.
+func _onlygo_gostring(p *byte) string {
+	if p == nil {
+		return ""
+	}
+	var b []byte
+	for p := unsafe.Pointer(p); *(*byte)(p) != 0; p = unsafe.Pointer(uintptr(p) + 1) {
+		b = append(b, *(*byte)(p))
+	}
+	return string(b)
+}
+`)
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "onlygo_errors.go"), formatted, 0666); err != nil {
+		panic(err)
+	}
+}
+
+// writeBatch writes the Batch type and, for each GOOS and GOARCH in platforms,
+// the assembly of the function that makes the calls recorded by it.
+func writeBatch(dir, pkg string, platforms [][2]string) {
+	var buf = &bytes.Buffer{}
+	buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n\n")
+	buf.WriteString(fmt.Sprintf("package %s\n\n", pkg))
+	writeImports(buf, "unsafe")
+	buf.WriteString(`// Batch records calls of the functions marked with //onlygo:batch and makes them
+// all with Run. The goroutine only enters and leaves the system call state once for
+// every call that Run makes. Its zero value is ready to use. A Batch must not be
+// used by more than one goroutine at the same time.
+type Batch struct {
+	calls []_onlygo_call
+	keep  []unsafe.Pointer // the pointer arguments which are kept alive until Run returns
+}
+
+// _onlygo_call is a call recorded by a Batch. The assembly reads its fields
+// at their offsets so their order and size must not change.
+type _onlygo_call struct {
+	fn     uintptr        // the address of the C function
+	ints   [8]uintptr     // the integer and pointer arguments in order
+	floats [8]uint64      // the bits of the floating point arguments in order
+	ret    uintptr        // the register that the C function returned
+	out    unsafe.Pointer // where the result is stored; nil if there is none
+	size   uintptr        // the size of the result
+	ptr    bool           // the result is a pointer
+}
+
+// _onlygo_batch makes the n calls that start at calls in order.
+// It is implemented in the assembly.
+func _onlygo_batch(calls *_onlygo_call, n int)
+
+// Len returns the number of calls that have been recorded since the last Run.
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// Run makes every recorded call in the order they were recorded and stores their
+// results. The Batch is empty afterwards and can be used again.
+func (b *Batch) Run() {
+	if len(b.calls) == 0 {
+		return
+	}
+	_onlygo_batch(&b.calls[0], len(b.calls))
+	for i := range b.calls {
+		var c = &b.calls[i]
+		switch {
+		case c.out == nil:
+		case c.ptr: // stored as a pointer so the GC sees the write
+			*(*unsafe.Pointer)(c.out) = *(*unsafe.Pointer)(unsafe.Pointer(&c.ret))
+		case c.size == 1:
+			*(*uint8)(c.out) = uint8(c.ret)
+		case c.size == 2:
+			*(*uint16)(c.out) = uint16(c.ret)
+		case c.size == 4:
+			*(*uint32)(c.out) = uint32(c.ret)
+		default:
+			*(*uint64)(c.out) = uint64(c.ret)
+		}
+		*c = _onlygo_call{}
+	}
+	for i := range b.keep {
+		b.keep[i] = nil
+	}
+	b.calls, b.keep = b.calls[:0], b.keep[:0]
+}
+`)
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "onlygo_batch.go"), formatted, 0666); err != nil {
+		panic(err)
+	}
+	for _, p := range platforms {
+		buf.Reset()
+		buf.WriteString("// File generated using onlygo. DO NOT EDIT!!!\n")
+		buf.WriteString("#include \"textflag.h\"\n")
+		buf.WriteString("#include \"funcdata.h\"\n\n")
+		var gen = generators[p[0]][p[1]](buf, Function{})
+		gen.Batch()
+		gen.StackHelper()
+		if err = os.WriteFile(filepath.Join(dir, "onlygo_batch_"+p[0]+"_"+p[1]+".s"), buf.Bytes(), 0666); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// writeFunc writes the assembly wrapper that calls the C function of f.
+// If resolve is true the wrapper calls its resolve function first
+// while the address of the C function is still zero. If track isn't empty
+// it is the prefix of the variables that count the calls in flight.
+func writeFunc(buf *bytes.Buffer, genFn func(io.Writer, Function) FuncGen, f Function, resolve, resolveWithDL bool, track string) {
+	gen := genFn(buf, f)
+	var name = f.name  // the name of the variable that has the address of the C function
+	if f.queue != "" { // the stub hands the call to a thread of the queue which calls the wrapper
+		buf.WriteString(fmt.Sprintf("//%s\n", f.sig))
+		buf.WriteString(fmt.Sprintf("TEXT ·%s(SB), NOSPLIT, $0-%d\n", f.name, f.argSize))
+		buf.WriteString(fmt.Sprintf("\tJMP ·_%s_dispatch(SB)\n\n", f.name))
+		f = f.direct()
+	}
+	buf.WriteString(fmt.Sprintf("//%s\n", f.sig))
+	switch {
+	case f.fast: // the frame has the call that is made on the system stack
+		buf.WriteString(fmt.Sprintf("TEXT ·%s(SB), NOSPLIT, $%d-%d\n", f.name, systemFrame, f.argSize))
+	case f.shared: // the frame has the address of the C function
+		buf.WriteString(fmt.Sprintf("TEXT ·%s(SB), NOSPLIT, $8-%d\n", f.name, f.argSize))
+	default:
+		buf.WriteString(fmt.Sprintf("TEXT ·%s(SB), NOSPLIT, $0-%d\n", f.name, f.argSize))
+	}
+	if f.shared {
+		name = ""
+	}
+	// The arguments are described by the Go prototype so that they are scanned and kept
+	// alive if the GC runs or the stack moves while the C function is executing.
+	buf.WriteString("\tGO_ARGS\n")
+	buf.WriteString("\tNO_LOCAL_POINTERS\n")
+	if f.shared {
+		gen.SaveContext()
+	}
+	if track != "" {
+		gen.Acquire(track)
+	}
+	if resolve {
+		gen.Resolve(name)
+	}
+	if !f.fast {
+		gen.PreCall()
+	}
+	if f.errno != nil && !f.fast { // the goroutine stays on this thread until the wrapper returns
+		gen.StackCall(nil, nil, "_errno", false)
+		gen.ClearErrno()
+	}
+	var args = f.args
+	var stack, fn *Type // the arguments that come before the ones of the C function
+	if f.stack {
+		stack, args = args[0], args[1:]
+	}
+	if f.indirect {
+		fn, args = args[0], args[1:]
+	}
+	for _, arg := range args {
+		gen.MovInst(arg)
+	}
+	if f.fast {
+		gen.SystemCall(fn, name, resolveWithDL, f.errno != nil)
+	} else {
+		gen.StackCall(stack, fn, name, resolveWithDL)
+	}
+	if f.ret.kind != VOID {
+		gen.RetInst(f.ret)
+	}
+	switch {
+	case f.errno != nil && f.fast:
+		gen.SystemErrno(f.errno)
+	case f.errno != nil:
+		gen.Errno(f.errno)
+	}
+	if !f.fast {
+		gen.PostCall()
+	}
+	if track != "" { // it can call Go to wake Close so it's after the system call
+		gen.Release(track)
+	}
+	buf.WriteString("\tRET\n\n")
+	if !f.indirect && !f.shared && !resolveWithDL { // the address of an imported symbol can't be loaded
+		buf.WriteString(fmt.Sprintf("TEXT %s_jmp<>(SB), NOSPLIT|NOFRAME, $0-0\n", name))
+		buf.WriteString(fmt.Sprintf("\tJMP _%s(SB)\n\n", name))
+	}
+}
+
+// writeJump writes the function of f that jumps to the shared wrapper w
+// with the address of the C function of f in the context register.
+func writeJump(buf *bytes.Buffer, genFn func(io.Writer, Function) FuncGen, f, w Function, resolveWithDL bool) {
+	buf.WriteString(fmt.Sprintf("//%s\n", f.sig))
+	buf.WriteString(fmt.Sprintf("TEXT ·%s(SB), NOSPLIT|NOFRAME, $0-%d\n", f.name, f.argSize))
+	genFn(buf, f).Jump(f.name, w.name, resolveWithDL)
+	buf.WriteString("\n")
+	if !resolveWithDL {
+		buf.WriteString(fmt.Sprintf("TEXT %s_jmp<>(SB), NOSPLIT|NOFRAME, $0-0\n", f.name))
+		buf.WriteString(fmt.Sprintf("\tJMP _%s(SB)\n\n", f.name))
+	}
+}
+
+// writeTrampoline writes a function that jumps to the symbol imported with
+// cgo_import_dynamic for f and stores its address in the variable that
+// the wrapper of f calls.
+func writeTrampoline(buf *bytes.Buffer, f Function) {
+	buf.WriteString(fmt.Sprintf("TEXT %s_trampoline<>(SB), NOSPLIT, $0-0\n", f.name))
+	buf.WriteString(fmt.Sprintf("\tJMP %s_sym(SB)\n\n", f.name))
+	buf.WriteString(fmt.Sprintf("GLOBL ·_%s(SB), RODATA, $8\n", f.name))
+	buf.WriteString(fmt.Sprintf("DATA ·_%s(SB)/8, $%s_trampoline<>(SB)\n\n", f.name, f.name))
+}
+
+// writeImports writes an import declaration of the standard library
+// packages followed by any others in imports.
+func writeImports(buf *bytes.Buffer, imports ...string) {
+	if len(imports) == 0 {
+		return
+	}
+	// the standard library packages are the ones without a dot in their path
+	sort.Slice(imports, func(i, j int) bool {
+		if a, b := strings.ContainsRune(imports[i], '.'), strings.ContainsRune(imports[j], '.'); a != b {
+			return b
+		}
+		return imports[i] < imports[j]
+	})
+	buf.WriteString("import (\n")
+	var last string
+	for _, imp := range imports {
+		if imp == last {
+			continue
+		}
+		if strings.ContainsRune(imp, '.') && last != "" && !strings.ContainsRune(last, '.') {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(fmt.Sprintf("\t\"%s\"\n", imp))
+		last = imp
+	}
+	buf.WriteString(")\n\n")
+}
+
+// platforms returns every GOOS and GOARCH pair matched by system and arch.
+// A * matches every GOOS or GOARCH that has a generator except ios, which
+// builds the files of darwin too.
+func platforms(system, arch string) (pairs [][2]string) {
+	var systems = []string{system}
+	if system == "*" {
+		systems = systems[:0]
+		for system := range generators {
+			if system == "ios" { // the files of darwin are also built for ios
+				continue
+			}
+			systems = append(systems, system)
+		}
+	}
+	for _, system := range systems {
+		if arch != "*" {
+			pairs = append(pairs, [2]string{system, arch})
+			continue
+		}
+		for arch := range generators[system] {
+			pairs = append(pairs, [2]string{system, arch})
+		}
+	}
+	return pairs
+}
+
+// dlopenFlags returns the value of flags on system and the names of the flags that
+// make up the value. The library is bound immediately and into the global scope
+// unless flags says otherwise.
+func dlopenFlags(system string, flags []string) (value int, names string) {
+	var binding, scope bool
+	for _, f := range flags {
+		binding = binding || f == "now" || f == "lazy"
+		scope = scope || f == "local" || f == "global"
+	}
+	if !binding {
+		flags = append(flags, "now")
+	}
+	if !scope {
+		flags = append(flags, "global")
+	}
+	var all []string
+	for _, f := range flags {
+		v, ok := rtld[system][f]
+		if !ok {
+			log.Printf("the dlopen flag %s is not supported on %s\n", f, system)
+			continue
+		}
+		value |= v
+		all = append(all, "RTLD_"+strings.ToUpper(f))
+	}
+	return value, strings.Join(all, "|")
+}
+
+// libIdent returns the prefix of the generated identifiers for the library name.
+func libIdent(fileNameNoExt, name string) string {
+	if name == "" {
+		return "_" + fileNameNoExt
+	}
+	return "_" + fileNameNoExt + "_" + name
+}
+
+// symbol returns the name of the C symbol including its version if it has one.
+func (f Function) symbol() string {
+	if f.version != "" {
+		return f.linkname + "@" + f.version
+	}
+	return f.linkname
+}
+
+// call returns the wrapper of f that calls the address passed in its first
+// argument instead of the address that Init resolved. If f is called by the
+// threads of a queue the stack to call it on comes before the address.
+func (f Function) call() Function {
+	if f.queue != "" {
+		return f.wrapper("_"+f.name+"_call", "_stack", "_fn")
+	}
+	return f.wrapper("_"+f.name+"_call", "_fn")
+}
+
+// direct returns the wrapper of f that the threads of its queue call on
+// the stack whose top is passed in its first argument.
+func (f Function) direct() Function {
+	return f.wrapper("_"+f.name+"_direct", "_stack")
+}
+
+// batchable reports whether f has a method on Batch. The calls of a queue
+// must be made by its threads, errno is only kept for the last call of a batch
+// and structs aren't passed in a single register.
+func (f Function) batchable() bool {
+	if f.queue != "" || f.errno != nil || f.ret.kind == STRUCT {
+		return false
+	}
+	for _, a := range f.args {
+		if a.kind == STRUCT {
+			return false
+		}
+	}
+	return true
+}
+
+// shape returns the wrapper named name that every function with the same
+// arguments and result as f after they are replaced by shapeType can share.
+// It is called with the address of the C function in the context register.
+func (f Function) shape(name string) Function {
+	var w = Function{name: name, fast: f.fast, shared: true}
+	var params []string
+	for i, a := range f.args {
+		var c = *a
+		c.name = fmt.Sprintf("a%d", i)
+		c.typ = shapeType(a)
+		w.args = append(w.args, &c)
+		params = append(params, c.name+" "+c.typ)
+	}
+	var ret = *f.ret
+	ret.name, ret.typ = "", f.result
+	w.ret = &ret
+	w.sig = "func " + name + "(" + strings.Join(params, ", ") + ")"
+	if ret.kind != VOID {
+		w.sig += " " + shapeType(&ret)
+	}
+	w.argSize = layout(w)
+	return w
+}
+
+// shapeType returns the Go type that stands in for ty in the wrapper of a shape.
+// Pointers stay pointers so that the GC still scans them while C is called.
+func shapeType(ty *Type) string {
+	switch ty.kind {
+	case U8:
+		return "uint8"
+	case I8:
+		return "int8"
+	case U16:
+		return "uint16"
+	case I16:
+		return "int16"
+	case U32:
+		return "uint32"
+	case I32:
+		return "int32"
+	case U64:
+		return "uint64"
+	case I64:
+		return "int64"
+	case UINT:
+		return "uint"
+	case INT:
+		return "int"
+	case F32:
+		return "float32"
+	case F64:
+		return "float64"
+	case PTR:
+		if ty.typ == "uintptr" {
+			return "uintptr"
+		}
+		return "unsafe.Pointer"
+	default:
+		panic(ty.kind)
+	}
+}
+
+// wrapper returns a copy of f named name that has the uintptr arguments
+// extra before its own. They are _stack, the top of the stack to call the
+// C function on, and _fn, the address of the C function, in that order.
+func (f Function) wrapper(name string, extra ...string) Function {
+	var c = f
+	c.name = name
+	c.queue, c.async = "", false // the wrapper is what the threads of the queue call
+	c.args = nil
+	for _, e := range extra {
+		c.args = append(c.args, &Type{name: e, kind: PTR})
+		c.stack = c.stack || e == "_stack"
+		c.indirect = c.indirect || e == "_fn"
+	}
+	for _, a := range f.args {
+		var a = *a // the copy gets its own offset
+		c.args = append(c.args, &a)
+	}
+	var ret = *f.ret
+	c.ret = &ret
+	if f.errno != nil {
+		var errno = *f.errno
+		c.errno = &errno
+	}
+	var params = strings.Join(extra, ", ") + " uintptr"
+	var rest = strings.TrimPrefix(f.sig, "func "+f.name+"(")
+	if strings.HasPrefix(rest, ")") {
+		c.sig = "func " + c.name + "(" + params + rest
+	} else {
+		c.sig = "func " + c.name + "(" + params + ", " + rest
+	}
+	c.argSize = layout(c)
+	return c
+}
+
+// lookup returns the Go expression that looks up the symbol of f
+// in the library lib that was opened from path in scope of the generated Init.
+func (f Function) lookup(fileNameNoExt string) string {
+	if f.version != "" {
+		return fmt.Sprintf("_%s_lookupVersion(lib, path, \"%s\", \"%s\")", fileNameNoExt, f.linkname, f.version)
+	}
+	return fmt.Sprintf("lib.Lookup(\"%s\")", f.linkname)
+}
+
+// sigImports returns the imports of file that are used by the signatures of functions.
+func sigImports(file *ast.File, functions []Function) (imports []string) {
+	for _, imp := range file.Imports {
+		path := strings.Trim(imp.Path.Value, `"`)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		for _, f := range functions {
+			if strings.Contains(f.sig, name+".") {
+				imports = append(imports, path)
+				break
+			}
+		}
+	}
+	return imports
+}
+
+// layout assigns the arguments and return value of fn their offsets in the
+// Go argument frame and returns the size of the frame. Each argument is aligned
+// to its own alignment and the results start at the next pointer sized boundary.
+func layout(fn Function) (size int) {
+	align := func(to int) {
+		for size%to != 0 {
+			size++
+		}
+	}
+	for _, a := range fn.args {
+		align(alignof(a))
+		a.offset = size
+		size += sizeof(a)
+	}
+	align(8)
+	if fn.ret.kind != VOID {
+		fn.ret.offset = size
+		size += sizeof(fn.ret)
+	}
+	if fn.errno != nil {
+		align(8)
+		fn.errno.offset = size
+		size += sizeof(fn.errno)
+	}
+	return size
+}
+
+// failure is how the result of a function fails for each check of //onlygo:error
+var failure = map[string]string{
+	"nonzero":  "returns a value other than zero",
+	"status":   "returns a status other than zero",
+	"negative": "returns a negative value",
+	"null":     "returns NULL",
+}
+
+// errorBody returns the body of the variant of f that returns an error. The
+// functions are called with the prefix recv and d describes the error code of f
+// if it has a name.
+func (f Function) errorBody(recv string, d Function) string {
+	var b = &strings.Builder{}
+	var params []string
+	for _, a := range f.args {
+		params = append(params, a.name)
+	}
+	var call = fmt.Sprintf("%s%s(%s)", recv, f.name, strings.Join(params, ", "))
+	var code = "_r" // the value that is described
+	if f.errno != nil {
+		code = "_errno"
+		fmt.Fprintf(b, "\t_r, _errno := %s\n", call)
+	} else {
+		fmt.Fprintf(b, "\t_r := %s\n", call)
+	}
+	switch {
+	case f.check == "negative":
+		b.WriteString("\tif _r < 0 {\n")
+	case f.check == "null" && f.result != "uintptr":
+		b.WriteString("\tif _r == nil {\n")
+	case f.check == "null":
+		b.WriteString("\tif _r == 0 {\n")
+	default:
+		b.WriteString("\tif _r != 0 {\n")
+	}
+	var fields = []string{fmt.Sprintf("Func: %q", f.symbol())}
+	if f.check != "null" {
+		fields = append(fields, "Code: int64(_r)")
+	}
+	if f.errno != nil {
+		fields = append(fields, "Errno: _errno")
+	}
+	if d.name != "" {
+		var msg = fmt.Sprintf("%s%s(%s(%s))", recv, d.name, d.args[0].typ, code)
+		if d.result != "*byte" {
+			msg = "(*byte)(" + msg + ")"
+		}
+		fields = append(fields, fmt.Sprintf("Message: _onlygo_gostring(%s)", msg))
+	}
+	fmt.Fprintf(b, "\t\treturn _r, &CallError{%s}\n\t}\n\treturn _r, nil\n", strings.Join(fields, ", "))
+	return b.String()
+}
+
+// integer reports whether ty is one of the integer kinds.
+func (ty *Type) integer() bool {
+	return ty.kind >= I8 && ty.kind <= UINT
+}
+
+// checkError makes sure that the result of f can be checked the way its
+// //onlygo:error directive says and returns the Go name of the function of
+// functions that describes its error code or empty if it has none.
+func checkError(f Function, functions []Function) string {
+	switch f.check {
+	case "nonzero", "status":
+		if !f.ret.integer() && f.result != "uintptr" {
+			log.Fatalf("%s must return an integer to use //onlygo:error %s", f.name, f.check)
+		}
+	case "negative":
+		if f.ret.kind < I8 || f.ret.kind > INT {
+			log.Fatalf("%s must return a signed integer to use //onlygo:error negative", f.name)
+		}
+	case "null":
+		if f.ret.kind != PTR {
+			log.Fatalf("%s must return a pointer to use //onlygo:error null", f.name)
+		}
+	}
+	if f.describe == "" {
+		if f.check == "status" {
+			log.Fatalf("%s must name the function that describes its status with //onlygo:error status=FUNC", f.name)
+		}
+		return ""
+	}
+	if f.check == "null" && f.errno == nil { // the code is errno
+		log.Fatalf("%s has no error code for %s to describe without //onlygo:errno", f.name, f.describe)
+	}
+	for _, d := range functions {
+		if d.name != f.describe && d.linkname != f.describe {
+			continue
+		}
+		if len(d.args) != 1 || !d.args[0].integer() || d.errno != nil || (d.result != "*byte" && d.result != "unsafe.Pointer") {
+			log.Fatalf("%s must take an integer and return a *byte or unsafe.Pointer to describe the errors of %s", d.name, f.name)
+		}
+		return d.name
+	}
+	log.Fatalf("%s describes the errors of %s but isn't in the stub file", f.describe, f.name)
+	return ""
+}
+
+// register returns the Go expression of the bits of the argument ty as the C
+// function receives them in a register. Values smaller than a register are
+// zero extended like the wrappers do.
+func (ty *Type) register() string {
+	switch ty.kind {
+	case U8, I8:
+		return fmt.Sprintf("uintptr(*(*uint8)(unsafe.Pointer(&%s)))", ty.name)
+	case U16, I16:
+		return fmt.Sprintf("uintptr(*(*uint16)(unsafe.Pointer(&%s)))", ty.name)
+	case U32, I32:
+		return fmt.Sprintf("uintptr(*(*uint32)(unsafe.Pointer(&%s)))", ty.name)
+	case F32:
+		return fmt.Sprintf("uint64(*(*uint32)(unsafe.Pointer(&%s)))", ty.name)
+	case F64:
+		return fmt.Sprintf("*(*uint64)(unsafe.Pointer(&%s))", ty.name)
+	default:
+		return fmt.Sprintf("*(*uintptr)(unsafe.Pointer(&%s))", ty.name)
 	}
 }
 
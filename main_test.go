@@ -0,0 +1,1437 @@
+package main
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// targets are the GOOS and GOARCH pairs that the generated code is vetted for
+var targets = [][2]string{{"linux", "amd64"}, {"linux", "arm64"}, {"darwin", "amd64"}, {"darwin", "arm64"}}
+
+// generateModule writes each of files to a new module in a temporary directory,
+// runs the generator on the files whose names end in .stub and returns the
+// directory. The stubs are renamed to end in .go before they are generated.
+func generateModule(t testing.TB, files map[string]string) string {
+	t.Helper()
+	var dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module fixture\n\ngo 1.21\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string // the stub files
+	for name, src := range files {
+		var path = filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".stub") {
+			path = strings.TrimSuffix(path, ".stub") + ".go"
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".stub") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	var stubs []Stub
+	for _, path := range paths {
+		stubs = append(stubs, generate(path))
+	}
+	writePackage(stubs)
+	return dir
+}
+
+// goCommand runs the go command with args in dir and env added to the
+// environment and fails the test with its output if it fails.
+func goCommand(t testing.TB, dir string, env []string, args ...string) string {
+	t.Helper()
+	var cmd = exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// vetModule vets the module in dir for every platform.
+func vetModule(t *testing.T, dir string) {
+	t.Helper()
+	for _, p := range targets {
+		goCommand(t, dir, []string{"GOOS=" + p[0], "GOARCH=" + p[1]}, "vet", "./...")
+	}
+}
+
+// testModule runs the tests of the module in dir without cgo.
+// It skips the test unless the host can load libc.so.6.
+func testModule(t *testing.T, dir string, env ...string) string {
+	t.Helper()
+	if runtime.GOOS != "linux" || (runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64") {
+		t.Skipf("the generated code can't run on %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip(err)
+	}
+	var out = goCommand(t, dir, append([]string{"CGO_ENABLED=0"}, env...), "test", "-count=1", "-v", "./...")
+	t.Log(out)
+	return out
+}
+
+// TestGC makes the GC run and goroutine stacks grow while C functions
+// that were passed pointers are executing.
+func TestGC(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+import "unsafe"
+
+//onlygo:resolve_with_cgo
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname memmove
+func Memmove(dst, src unsafe.Pointer, n uintptr) unsafe.Pointer
+
+// req and rem point to the seconds and nanoseconds of a timespec
+//
+//onlygo:linkname nanosleep
+func Nanosleep(req, rem *int64) int32
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+// grow uses n KB of stack.
+func grow(n int) byte {
+	var b [1024]byte
+	if n == 0 {
+		return b[0]
+	}
+	return grow(n-1) + b[n%len(b)]
+}
+
+func TestGC(t *testing.T) {
+	var stop = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				runtime.GC()
+				grow(256)
+			}
+		}()
+	}
+	var calls sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		calls.Add(1)
+		go func(g int) {
+			defer calls.Done()
+			for i := 0; i < 20; i++ {
+				// only the arguments of the wrapper keep the buffers alive
+				var src = make([]byte, 8<<20)
+				src[len(src)-1] = byte(g + i)
+				var dst = make([]byte, len(src))
+				Memmove(unsafe.Pointer(&dst[0]), unsafe.Pointer(&src[0]), uintptr(len(src)))
+				if dst[len(dst)-1] != byte(g+i) {
+					t.Errorf("memmove copied %d, want %d", dst[len(dst)-1], byte(g+i))
+				}
+				// the request is on the stack of the goroutine
+				var req = [2]int64{0, 5e6}
+				if r := Nanosleep(&req[0], nil); r != 0 {
+					t.Errorf("nanosleep returned %d", r)
+				}
+				grow(g * 8)
+			}
+		}(g)
+	}
+	calls.Wait()
+	close(stop)
+	wg.Wait()
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir, "GOGC=1")
+}
+
+// TestSHA256 generates a stub file whose only checked directive is //onlygo:sha256
+// and makes sure Init only opens the library if its sum matches.
+func TestSHA256(t *testing.T) {
+	var sum = strings.Repeat("0", 64) // the sum on the platforms that are only vetted
+	if runtime.GOOS == "linux" {
+		for _, dir := range libraryPath["linux"][runtime.GOARCH] {
+			if data, err := os.ReadFile(filepath.Join(dir, "libc.so.6")); err == nil {
+				sum = fmt.Sprintf("%x", sha256.Sum256(data))
+				break
+			}
+		}
+	}
+	const junk = "not a library" // a file in the working directory that isn't in the library path
+	for _, tt := range []struct {
+		name, sum string
+		lib       string // the library that is opened on linux
+		want      string // the condition that the error of Init must meet
+	}{
+		{"match", sum, "libc.so.6", "errors.Is(err, nil)"},
+		{"mismatch", strings.Repeat("f", 64), "libc.so.6", "errors.Is(err, ErrChecksum)"},
+		{"working directory", fmt.Sprintf("%x", sha256.Sum256([]byte(junk))), "libjunk.so.1", "errors.Is(err, os.ErrNotExist)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var dir = generateModule(t, map[string]string{
+				"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * ` + tt.lib + `
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+//onlygo:sha256 linux * ` + tt.sum + `
+//onlygo:sha256 darwin * ` + tt.sum + `
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+				"libjunk.so.1": junk,
+				"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	var err = Init()
+	if !(` + tt.want + `) {
+		t.Fatalf("Init() = %v, want ` + tt.want + `", err)
+	}
+	if err == nil && Strlen(&[]byte("abc\x00")[0]) != 3 {
+		t.Fatal("strlen didn't return 3")
+	}
+}
+
+var _ = os.ErrNotExist // os is only used by some of the conditions
+`,
+			})
+			vetModule(t, dir)
+			testModule(t, dir)
+		})
+	}
+}
+
+// TestMissingSymbol makes sure that Init returns a *LoadError when the library
+// or a symbol is missing. dlerror, which describes them, needs the bootstrap.
+func TestMissingSymbol(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+//onlygo:open linux * libmissing.so.1 missing
+//onlygo:open darwin * libmissing.1.dylib missing
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+
+//onlygo:linkname onlygo_missing_symbol
+func Missing()
+
+//onlygo:lib missing
+//onlygo:linkname strlen
+func MissingLib(s *byte) uintptr
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	var err = Init()
+	var loadErrs int
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var le *LoadError
+		if !errors.As(err, &le) {
+			t.Fatalf("%v isn't a *LoadError", err)
+		}
+		loadErrs++
+		switch {
+		case strings.Contains(le.Library, "libmissing"):
+			if le.Err == nil {
+				t.Errorf("opening %s returned no error", le.Library)
+			}
+		case len(le.Missing) != 1 || le.Missing[0].Name != "Missing":
+			t.Errorf("%s is missing %v, want only Missing", le.Library, le.Missing)
+		}
+	}
+	if loadErrs != 2 {
+		t.Fatalf("Init() = %v, want an error for each library", err)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestVersionLocal looks up a versioned symbol in a library that is opened
+// with RTLD_LOCAL so it can't be found in the global scope.
+func TestVersionLocal(t *testing.T) {
+	var found bool
+	for _, dir := range libraryPath["linux"][runtime.GOARCH] {
+		if _, err := os.Stat(filepath.Join(dir, "libcrypto.so.3")); err == nil {
+			found = true
+		}
+	}
+	if runtime.GOOS == "linux" && !found {
+		t.Skip("libcrypto.so.3 isn't installed")
+	}
+	var dir = generateModule(t, map[string]string{
+		"crypto.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:dlopen local
+//onlygo:open linux * libcrypto.so.3
+//onlygo:open darwin * libcrypto.3.dylib
+
+//onlygo:linkname OpenSSL_version_num@OPENSSL_3.0.0
+func VersionNum() uint64
+`,
+		"crypto_test.go": `package fixture
+
+import "testing"
+
+func TestInit(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if v := VersionNum(); v>>28 != 3 {
+		t.Fatalf("OpenSSL_version_num() = %#x, want version 3", v)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestBootstrap calls functions of libc that use its thread local storage
+// from many goroutines at once without cgo.
+func TestBootstrap(t *testing.T) {
+	for _, tt := range []struct {
+		mode, init string // init opens the library if it isn't linked to
+	}{
+		{"resolve_with_cgo", ""},
+		{"builtin_dl", "\n\tif err := Init(); err != nil {\n\t\tt.Fatal(err)\n\t}"},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			var dir = generateModule(t, map[string]string{
+				"libc.stub": `package fixture
+
+import "unsafe"
+
+//onlygo:` + tt.mode + `
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname malloc
+func Malloc(size uintptr) unsafe.Pointer
+
+//onlygo:linkname free
+func Free(p unsafe.Pointer)
+
+//onlygo:linkname strerror
+func Strerror(errnum int32) *byte
+
+//onlygo:linkname toupper
+func Toupper(c int32) int32
+`,
+				"libc_test.go": `package fixture
+
+import (
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestBootstrap(t *testing.T) {` + tt.init + `
+	var wg sync.WaitGroup
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				var p = Malloc(uintptr(16 + g + i))
+				if p == nil {
+					t.Error("malloc returned nil")
+					return
+				}
+				*(*byte)(p) = byte(g)
+				Free(p)
+				var b []byte
+				for s := unsafe.Pointer(Strerror(2)); *(*byte)(s) != 0; s = unsafe.Pointer(uintptr(s) + 1) {
+					b = append(b, *(*byte)(s))
+				}
+				if string(b) != "No such file or directory" {
+					t.Errorf("strerror(ENOENT) = %q", b)
+					return
+				}
+				if c := Toupper('a'); c != 'A' {
+					t.Errorf("toupper('a') = %q", c)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+`,
+			})
+			vetModule(t, dir)
+			testModule(t, dir)
+		})
+	}
+}
+
+// TestResolveWithCgo checks that the internal linker makes a dynamically linked
+// ELF from a //onlygo:resolve_with_cgo stub for each linux GOARCH and runs
+// the libc call on the host.
+func TestResolveWithCgo(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:resolve_with_cgo
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+		"libc_test.go": `package fixture
+
+import "testing"
+
+func TestStrlen(t *testing.T) {
+	if n := Strlen(&[]byte("hello\x00")[0]); n != 5 {
+		t.Fatalf("strlen(\"hello\") = %d, want 5", n)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	for _, arch := range []string{"amd64", "arm64"} {
+		t.Run(arch, func(t *testing.T) {
+			var bin = filepath.Join(t.TempDir(), "fixture.test")
+			goCommand(t, dir, []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=" + arch}, "test", "-c", "-o", bin, ".")
+			f, err := elf.Open(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var interp bool
+			for _, p := range f.Progs {
+				interp = interp || p.Type == elf.PT_INTERP
+			}
+			if !interp {
+				t.Error("the binary has no dynamic interpreter")
+			}
+			libs, err := f.ImportedLibraries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(strings.Join(libs, " "), "libc.so.6") {
+				t.Errorf("the binary needs %v, want libc.so.6", libs)
+			}
+			syms, err := f.ImportedSymbols()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var imported bool
+			for _, sym := range syms {
+				imported = imported || sym.Name == "strlen"
+			}
+			if !imported {
+				t.Error("strlen isn't imported")
+			}
+		})
+	}
+	testModule(t, dir)
+}
+
+// TestFastcall calls functions marked with //onlygo:fastcall on the system stack
+// while the GC runs and other goroutines grow their stacks.
+func TestFastcall(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+import "syscall"
+
+//onlygo:resolve_with_cgo
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:fastcall
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+
+//onlygo:fastcall
+//onlygo:linkname toupper
+func Toupper(c int32) int32
+
+//onlygo:fastcall
+//onlygo:errno
+//onlygo:linkname access
+func Access(path *byte, mode int32) (int32, syscall.Errno)
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// grow uses n KB of stack.
+func grow(n int) byte {
+	var b [1024]byte
+	if n == 0 {
+		return b[0]
+	}
+	return grow(n-1) + b[n%len(b)]
+}
+
+func TestFastcall(t *testing.T) {
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				var s = make([]byte, g+i%64+1)
+				for j := range s[:len(s)-1] {
+					s[j] = 'x'
+				}
+				if n := Strlen(&s[0]); n != uintptr(len(s)-1) {
+					t.Errorf("strlen = %d, want %d", n, len(s)-1)
+					return
+				}
+				if c := Toupper('a' + int32(i%26)); c != 'A'+int32(i%26) {
+					t.Errorf("toupper = %q", c)
+					return
+				}
+				if r, errno := Access(&[]byte("/nonexistent\x00")[0], 0); r != -1 || errno != syscall.ENOENT {
+					t.Errorf("access = %d, %v, want -1, ENOENT", r, errno)
+					return
+				}
+				if i%100 == 0 {
+					runtime.GC()
+					grow(g)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir, "GOFLAGS=-ldflags=-checklinkname=0")
+}
+
+// TestDirectives generates a stub file for each directive and vets the generated
+// code for every platform. The stubs use builtin_dl or resolve_with_cgo so that
+// the module doesn't depend on github.com/totallygamerjet/dl.
+func TestDirectives(t *testing.T) {
+	const libc = `
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+`
+	const strlen = `
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`
+	for _, tt := range []struct {
+		name   string
+		header string // the directives of the file
+		funcs  string // the stubs
+		files  map[string]string
+	}{
+		{name: "fastcall", header: "//onlygo:resolve_with_cgo" + libc, funcs: `
+//onlygo:fastcall
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`},
+		{name: "builtin_dl", header: "//onlygo:builtin_dl" + libc, funcs: strlen},
+		{name: "bootstrap", header: "//onlygo:builtin_dl\n//onlygo:bootstrap" + libc, funcs: strlen},
+		{name: "dlopen", header: "//onlygo:builtin_dl\n//onlygo:dlopen lazy local m" + libc + `//onlygo:open linux * libm.so.6 m
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib m
+`, funcs: strlen + `
+//onlygo:lib m
+//onlygo:linkname abs
+func Abs(x int32) int32
+`},
+		{name: "preload", header: "//onlygo:builtin_dl" + libc + "//onlygo:preload linux * libm.so.6\n", funcs: strlen},
+		{name: "unload", header: "//onlygo:builtin_dl\n//onlygo:unload" + libc, funcs: strlen + `
+//onlygo:fastcall
+//onlygo:linkname toupper
+func Toupper(c int32) int32
+
+//onlygo:optional
+//onlygo:linkname getentropy
+func Getentropy(buf unsafe.Pointer, size uintptr) int32
+`},
+		{name: "autoinit", header: "//onlygo:builtin_dl\n//onlygo:autoinit" + libc, funcs: strlen},
+		{name: "autoinit record", header: "//onlygo:builtin_dl\n//onlygo:autoinit record" + libc, funcs: strlen},
+		{name: "mainthread", header: "//onlygo:builtin_dl" + libc, funcs: `
+//onlygo:mainthread
+//onlygo:linkname usleep
+func Usleep(usec uint32) int32
+`},
+		{name: "version", header: "//onlygo:builtin_dl" + libc, funcs: `
+//onlygo:linkname memcpy@GLIBC_2.2.5
+func Memcpy(dst, src unsafe.Pointer, n uintptr) unsafe.Pointer
+`},
+		{name: "sha256", header: "//onlygo:builtin_dl" + libc + "//onlygo:sha256 * * " + strings.Repeat("0", 64) + "\n", funcs: strlen},
+		{name: "fastcall shapes", header: "//onlygo:builtin_dl\n//onlygo:shapes" + libc, funcs: `
+//onlygo:fastcall
+//onlygo:linkname abs
+func Abs(x int32) int32
+
+//onlygo:fastcall
+//onlygo:linkname toupper
+func Toupper(c int32) int32
+`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var files = map[string]string{"libc.stub": `package fixture
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var _ syscall.Errno
+var _ unsafe.Pointer
+
+` + tt.header + tt.funcs}
+			for name, src := range tt.files {
+				files[name] = src
+			}
+			var dir = generateModule(t, files)
+			t.Parallel() // the stubs are generated one at a time
+			vetModule(t, dir)
+		})
+	}
+}
+
+// TestTwoPackages links two packages that use builtin_dl and errno into one program.
+// Only a package that asks for the bootstrap defines the symbols of runtime/cgo.
+func TestTwoPackages(t *testing.T) {
+	const stub = `
+//onlygo:builtin_dl
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:errno
+//onlygo:linkname strlen
+func Strlen(s *byte) (uintptr, syscall.Errno)
+`
+	var dir = generateModule(t, map[string]string{
+		"a/libc.stub": "package a\n\nimport \"syscall\"\n" + stub,
+		"b/libc.go":   "package b\n\nimport \"syscall\"\n" + stub,
+		"main.go": `package main
+
+import (
+	"fixture/a"
+	"fixture/b"
+)
+
+func main() {
+	_ = a.Init()
+	_ = b.Init()
+}
+`,
+	})
+	writePackage([]Stub{generate(filepath.Join(dir, "b", "libc.go"))})
+	for _, p := range targets {
+		goCommand(t, dir, []string{"CGO_ENABLED=0", "GOOS=" + p[0], "GOARCH=" + p[1]}, "build", "-o", os.DevNull, ".")
+	}
+}
+
+// TestIOS builds a stub file opened for every platform for ios, which also builds
+// the files of darwin.
+func TestIOS(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:open * * libc.so.6
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+	})
+	goCommand(t, dir, []string{"CGO_ENABLED=0", "GOOS=ios", "GOARCH=arm64"}, "build", ".")
+}
+
+// TestSeparateGenerate generates two stub files of a package one at a time like
+// two go:generate lines do. The package files must still be written from both.
+func TestSeparateGenerate(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.go": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+		"libm.go": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:open linux * libm.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:optional
+//onlygo:linkname missing_function
+func Missing() int32
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if Strlen(&[]byte("abc\x00")[0]) != 3 {
+		t.Fatal("strlen didn't return 3")
+	}
+	if HasMissing() {
+		t.Fatal("missing_function is available")
+	}
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("Missing panicked with %v, want ErrUnavailable", err)
+		}
+	}()
+	Missing()
+}
+`,
+	})
+	for _, name := range []string{"libm.go", "libc.go"} {
+		generateFiles([]string{filepath.Join(dir, name)})
+	}
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestDlopenErrors generates stub files whose //onlygo:dlopen directive has a token
+// that isn't a flag or a declared library. The generator exits so it is run by
+// the test binary in another process.
+func TestDlopenErrors(t *testing.T) {
+	if path := os.Getenv("ONLYGO_STUB"); path != "" {
+		generateFiles([]string{path})
+		return
+	}
+	for _, tt := range []struct {
+		name, directive, want string
+	}{
+		{"misspelled flag", "//onlygo:dlopen gloabl", "gloabl is neither a flag of dlopen nor a library"},
+		{"two names", "//onlygo:dlopen local m libc", "names more than one library"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var path = filepath.Join(t.TempDir(), "libm.go")
+			var src = `package fixture
+
+//onlygo:builtin_dl
+` + tt.directive + `
+//onlygo:open linux * libm.so.6 m
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib m
+
+//onlygo:lib m
+//onlygo:linkname abs
+func Abs(x int32) int32
+`
+			if err := os.WriteFile(path, []byte(src), 0666); err != nil {
+				t.Fatal(err)
+			}
+			var cmd = exec.Command(os.Args[0], "-test.run=^TestDlopenErrors$")
+			cmd.Env = append(os.Environ(), "ONLYGO_STUB="+path)
+			out, err := cmd.CombinedOutput()
+			if err == nil || !strings.Contains(string(out), tt.want) {
+				t.Fatalf("generating %s: %v, want an error containing %q\n%s", tt.directive, err, tt.want, out)
+			}
+		})
+	}
+}
+
+// TestEmbed embeds a copy of libz from the host and calls it once Init has loaded it.
+func TestEmbed(t *testing.T) {
+	var libz []byte
+	for _, dir := range libraryPath["linux"][runtime.GOARCH] {
+		if data, err := os.ReadFile(filepath.Join(dir, "libz.so.1")); err == nil {
+			libz = data
+			break
+		}
+	}
+	if runtime.GOOS == "linux" && libz == nil {
+		t.Skip("libz.so.1 isn't installed")
+	}
+	var dir = generateModule(t, map[string]string{
+		"libz.so.1": string(libz),
+		"libz.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libz.so.1
+//onlygo:open darwin * /usr/lib/libz.1.dylib
+//onlygo:embed linux * libz.so.1
+
+//onlygo:linkname zlibVersion
+func ZlibVersion() *byte
+`,
+		"libz_test.go": `package fixture
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestInit(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	var v = unsafe.Slice(ZlibVersion(), 2)
+	if string(v) != "1." {
+		t.Fatalf("zlibVersion() = %q..., want 1.", v)
+	}
+	maps, err := os.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(maps), "/memfd:libz.so.1") {
+		t.Fatalf("the embedded libz isn't mapped\n%s", maps)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestLibrary opens libc with Open, which verifies it like Init, calls it through
+// the Library and closes it.
+func TestLibrary(t *testing.T) {
+	var sum = strings.Repeat("0", 64) // the sum on the platforms that are only vetted
+	if runtime.GOOS == "linux" {
+		for _, dir := range libraryPath["linux"][runtime.GOARCH] {
+			if data, err := os.ReadFile(filepath.Join(dir, "libc.so.6")); err == nil {
+				sum = fmt.Sprintf("%x", sha256.Sum256(data))
+				break
+			}
+		}
+	}
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:library
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+//onlygo:sha256 * * ` + sum + `
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+		"libjunk.so.1": "not a library",
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	l, err := Open("libc.so.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := l.Strlen(&[]byte("abc\x00")[0]); n != 3 {
+		t.Fatalf("Strlen() = %d, want 3", n)
+	}
+	if l.Path() == "" {
+		t.Fatal("Path() is empty")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var loadErr *LoadError
+	if _, err := Open("./libjunk.so.1"); !errors.Is(err, ErrChecksum) || !errors.As(err, &loadErr) {
+		t.Fatalf("Open(./libjunk.so.1) = %v, want a *LoadError wrapping ErrChecksum", err)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestUnload closes libc while a call is executing and opens it again.
+func TestUnload(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:unload
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname usleep
+func Usleep(usec uint32) int32
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// strlen calls Strlen and returns what it panicked with.
+func strlen() (err error) {
+	defer func() {
+		err, _ = recover().(error)
+	}()
+	if n := Strlen(&[]byte("abc\x00")[0]); n != 3 {
+		return errors.New("strlen didn't return 3")
+	}
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan struct{})
+	go func() {
+		Usleep(200000)
+		close(done)
+	}()
+	for atomic.LoadInt64(&_libc_inflight) == 0 { // the call is executing
+		runtime.Gosched()
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("Close returned before the call in flight")
+	}
+	if err := strlen(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Strlen after Close panicked with %v, want ErrClosed", err)
+	}
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := strlen(); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestBatch records calls with integer, pointer and floating point arguments
+// and checks the result of each once Run has made them.
+func TestBatch(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:batch
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+//onlygo:open linux * libm.so.6 m
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib m
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+
+//onlygo:linkname abs
+func Abs(x int32) int32
+
+//onlygo:lib m
+//onlygo:linkname lrintf
+func Lrintf(x float32) int64
+`,
+		"libc_test.go": `package fixture
+
+import "testing"
+
+func TestRun(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	var n = b.Strlen(&[]byte("hello\x00")[0])
+	var a = b.Abs(-7)
+	var r = b.Lrintf(2.75)
+	if b.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", b.Len())
+	}
+	b.Run()
+	if *n != 5 {
+		t.Errorf("strlen(\"hello\") = %d, want 5", *n)
+	}
+	if *a != 7 {
+		t.Errorf("abs(-7) = %d, want 7", *a)
+	}
+	if *r != 3 {
+		t.Errorf("lrintf(2.75) = %d, want 3", *r)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Len() = %d after Run, want 0", b.Len())
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestShapes calls two functions of the same shape, which share a wrapper and only
+// differ in the address that they jump to it with.
+func TestShapes(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:shapes
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname abs
+func Abs(x int32) int32
+
+//onlygo:linkname toupper
+func Toupper(c int32) int32
+`,
+		"libc_test.go": `package fixture
+
+import "testing"
+
+func TestShared(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(0); i < 26; i++ {
+		if got := Abs(-i); got != i {
+			t.Fatalf("abs(%d) = %d, want %d", -i, got, i)
+		}
+		if got := Toupper('a' + i); got != 'A'+i {
+			t.Fatalf("toupper(%q) = %q, want %q", 'a'+i, got, 'A'+i)
+		}
+	}
+}
+`,
+	})
+	if data, err := os.ReadFile(filepath.Join(dir, "libc_shapes.go")); err != nil || strings.Count(string(data), "func _libc_shape") != 1 {
+		t.Fatalf("abs and toupper don't share one wrapper: %v\n%s", err, data)
+	}
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestErrno checks the errno of a call that fails and of one that succeeds after it.
+func TestErrno(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+import "syscall"
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:errno
+//onlygo:linkname open
+func Open(path *byte, flags int32) (int32, syscall.Errno)
+
+//onlygo:errno
+//onlygo:linkname close
+func Close(fd int32) (int32, syscall.Errno)
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if fd, errno := Open(&[]byte("/nonexistent\x00")[0], 0); fd != -1 || errno != syscall.ENOENT {
+			t.Fatalf("open(/nonexistent) = %d, %v, want -1, ENOENT", fd, errno)
+		}
+		fd, errno := Open(&[]byte("/dev/null\x00")[0], 0)
+		if fd < 0 || errno != 0 {
+			t.Fatalf("open(/dev/null) = %d, %v, want a descriptor and 0", fd, errno)
+		}
+		if r, errno := Close(fd); r != 0 || errno != 0 {
+			t.Fatalf("close(%d) = %d, %v, want 0, 0", fd, r, errno)
+		}
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestCallError calls the Err variant of a function of each kind of //onlygo:error
+// once so that it fails and once so that it succeeds.
+func TestCallError(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+import "syscall"
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:errno
+//onlygo:error negative=strerror
+//onlygo:linkname open
+func Open(path *byte, flags int32) (int32, syscall.Errno)
+
+//onlygo:linkname close
+func Close(fd int32) int32
+
+//onlygo:error null
+//onlygo:linkname strchr
+func Strchr(s *byte, c int32) *byte
+
+//onlygo:error nonzero
+//onlygo:linkname access
+func Access(path *byte, mode int32) int32
+
+//onlygo:linkname strerror
+func Strerror(errnum int32) *byte
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestErr(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	var missing, null = &[]byte("/nonexistent\x00")[0], &[]byte("/dev/null\x00")[0]
+	var callErr *CallError
+
+	// negative
+	if fd, err := OpenErr(missing, 0); fd != -1 || !errors.As(err, &callErr) || !errors.Is(err, fs.ErrNotExist) || callErr.Message == "" {
+		t.Errorf("OpenErr(/nonexistent) = %d, %v, want -1 and a *CallError with ENOENT and a message", fd, err)
+	}
+	if fd, err := OpenErr(null, 0); fd < 0 || err != nil {
+		t.Errorf("OpenErr(/dev/null) = %d, %v, want a descriptor and no error", fd, err)
+	} else {
+		Close(fd)
+	}
+
+	// null
+	var s = &[]byte("abc\x00")[0]
+	if p, err := StrchrErr(s, 'x'); p != nil || !errors.As(err, &callErr) || callErr.Func != "strchr" {
+		t.Errorf("StrchrErr(abc, x) = %v, %v, want nil and a *CallError", p, err)
+	}
+	if p, err := StrchrErr(s, 'b'); p == nil || *p != 'b' || err != nil {
+		t.Errorf("StrchrErr(abc, b) = %v, %v, want the b and no error", p, err)
+	}
+
+	// nonzero
+	if r, err := AccessErr(missing, 0); r != -1 || !errors.As(err, &callErr) || callErr.Code != -1 {
+		t.Errorf("AccessErr(/nonexistent) = %d, %v, want -1 and a *CallError with the code -1", r, err)
+	}
+	if r, err := AccessErr(null, 0); r != 0 || err != nil {
+		t.Errorf("AccessErr(/dev/null) = %d, %v, want 0 and no error", r, err)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestLazy calls functions that resolve their symbols on the first call without
+// calling Init. The one whose symbol is missing panics with a *LoadError.
+func TestLazy(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:lazy
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+
+//onlygo:linkname missing_function
+func Missing() int32
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	if n := Strlen(&[]byte("abc\x00")[0]); n != 3 {
+		t.Fatalf("strlen(abc) = %d, want 3", n)
+	}
+	defer func() {
+		var loadErr *LoadError
+		if err, _ := recover().(error); !errors.As(err, &loadErr) || len(loadErr.Missing) != 1 || loadErr.Missing[0].Linkname != "missing_function" {
+			t.Fatalf("Missing panicked with %v, want a *LoadError missing missing_function", err)
+		}
+	}()
+	Missing()
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestOptional checks that a missing optional symbol doesn't make Init fail and
+// that calling it panics with ErrUnavailable while one that was found works.
+func TestOptional(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:optional
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+
+//onlygo:optional
+//onlygo:linkname missing_function
+func Missing() int32
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHas(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !HasStrlen() || HasMissing() {
+		t.Fatalf("HasStrlen() = %v and HasMissing() = %v, want true and false", HasStrlen(), HasMissing())
+	}
+	if n := Strlen(&[]byte("abc\x00")[0]); n != 3 {
+		t.Fatalf("strlen(abc) = %d, want 3", n)
+	}
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("Missing panicked with %v, want ErrUnavailable", err)
+		}
+	}()
+	Missing()
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestWorker makes calls on a pool of two worker threads from many goroutines.
+func TestWorker(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:workers 2
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:worker async
+//onlygo:linkname usleep
+func Usleep(usec uint32) int32
+
+//onlygo:worker
+//onlygo:linkname strlen
+func Strlen(s *byte) uintptr
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var s = make([]byte, i+1)
+			for j := range s[:i] {
+				s[j] = 'x'
+			}
+			if n := Strlen(&s[0]); n != uintptr(i) {
+				t.Errorf("strlen = %d, want %d", n, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the two workers make four calls of 100ms in at least 200ms
+	var start = time.Now()
+	var results []<-chan int32
+	for i := 0; i < 4; i++ {
+		results = append(results, UsleepAsync(100000))
+	}
+	for _, r := range results {
+		if got := <-r; got != 0 {
+			t.Fatalf("usleep = %d, want 0", got)
+		}
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("four calls of 100ms took %v on two workers", d)
+	}
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
+
+// TestThreadAffine calls functions of one group from many goroutines and checks
+// that they all run on the same thread.
+func TestThreadAffine(t *testing.T) {
+	var dir = generateModule(t, map[string]string{
+		"libc.stub": `package fixture
+
+//onlygo:builtin_dl
+//onlygo:bootstrap
+//onlygo:open linux * libc.so.6
+//onlygo:open darwin * /usr/lib/libSystem.B.dylib
+
+//onlygo:threadaffine gl
+//onlygo:linkname pthread_self
+func PthreadSelf() uintptr
+
+//onlygo:threadaffine gl async
+//onlygo:linkname gettid
+func Gettid() int32
+`,
+		"libc_test.go": `package fixture
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSameThread(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	var self, tid = PthreadSelf(), Gettid()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := PthreadSelf(); got != self {
+					t.Errorf("pthread_self() = %#x, want %#x", got, self)
+					return
+				}
+				if got := <-GettidAsync(); got != tid {
+					t.Errorf("gettid() = %d, want %d", got, tid)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+`,
+	})
+	vetModule(t, dir)
+	testModule(t, dir)
+}
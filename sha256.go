@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+)
+
+// sha256Command prints an //onlygo:sha256 directive for each of the files
+// in args so that they can be pasted into a stub file.
+//
+//	onlygo sha256 [-os GOOS] [-arch GOARCH] [-lib NAME] FILE...
+func sha256Command(args []string) {
+	flags := flag.NewFlagSet("sha256", flag.ExitOnError)
+	system := flags.String("os", runtime.GOOS, "the GOOS the files are loaded on")
+	arch := flags.String("arch", runtime.GOARCH, "the GOARCH the files are loaded on")
+	name := flags.String("lib", "", "the name of the library the files are for")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		log.Fatal("no files specified")
+	}
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		_ = f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		directive := fmt.Sprintf("//onlygo:sha256 %s %s %s", *system, *arch, hex.EncodeToString(h.Sum(nil)))
+		if *name != "" {
+			directive += " " + *name
+		}
+		fmt.Println(directive)
+	}
+}